@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+// NIP-42 client authentication event.
+const KindClientAuth uint32 = 22242
+
+// NIP-42 state of a connection. Reset on every new socket and only touched
+// by the reader goroutine, apart from the secret key set before Listen.
+type authState struct {
+
+	// Private key used to sign AUTH events. Empty means auth is not allowed on this relay.
+	sk string
+
+	// Id of the AUTH event waiting for an OK from the relay.
+	pending string
+
+	// Set once the relay accepted our AUTH event.
+	authenticated bool
+
+	// Subscriptions closed with auth-required, re-issued after authenticating.
+	retry []string
+
+	// Subscriptions already retried once, so a relay that keeps refusing does not loop.
+	retried map[string]bool
+}
+
+func (s *authState) reset() {
+	s.pending = ""
+	s.authenticated = false
+	s.retry = nil
+	s.retried = make(map[string]bool)
+}
+
+// Allow the connection to answer NIP-42 AUTH challenges by signing with
+// the given private key. Call before Listen.
+func (s *Connection) EnableAuth(sk string) {
+	s.auth.sk = sk
+}
+
+// NIP-42 challenge from the relay: ["AUTH", <challenge>]
+// Kept until the relay sends a new one, and answered if auth is allowed.
+func (s *Connection) handleAuth(fields []json.RawMessage) {
+
+	var challenge string
+	if len(fields) > 0 {
+		json.Unmarshal(fields[0], &challenge)
+	}
+
+	s.mu.Lock()
+	s.challenge = challenge
+	s.mu.Unlock()
+
+	log.Printf("relay %s: AUTH challenge received", s.url)
+
+	if s.auth.sk == "" {
+		return
+	}
+
+	err := s.authenticate(challenge)
+	if err != nil {
+		s.fail("auth", err)
+	}
+}
+
+// Sign a kind 22242 event for the relay and challenge and send it:
+// ["AUTH", <signed event>]
+func (s *Connection) authenticate(challenge string) error {
+
+	pub, err := nostr.GetPublicKey(s.auth.sk)
+	if err != nil {
+		return err
+	}
+
+	event := nostr.Event{
+		PubKey:    pub,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Kind:      KindClientAuth,
+		Tags: nostr.Tags{
+			{"relay", s.url},
+			{"challenge", challenge},
+		},
+	}
+
+	// We have to sign last, since the signature is dependent on the event content.
+	// Unsigned, the AUTH is neither sent nor waited for.
+	err = event.Sign(s.auth.sk)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal([]any{"AUTH", event})
+	if err != nil {
+		return err
+	}
+
+	s.auth.pending = event.GetId()
+	s.auth.authenticated = false
+
+	return s.writeMessage(bytes)
+}
+
+// Handle the relay's OK for our AUTH event: ["OK", <event id>, <accepted>, <message>]
+// Returns false if the OK is for some other event.
+func (s *Connection) handleAuthOk(fields []json.RawMessage) bool {
+
+	if len(fields) < 2 || s.auth.pending == "" {
+		return false
+	}
+
+	var id, msg string
+	var accepted bool
+
+	json.Unmarshal(fields[0], &id)
+	json.Unmarshal(fields[1], &accepted)
+	if len(fields) > 2 {
+		json.Unmarshal(fields[2], &msg)
+	}
+
+	if id != s.auth.pending {
+		return false
+	}
+
+	s.auth.pending = ""
+	s.auth.authenticated = accepted
+
+	retry := s.auth.retry
+	s.auth.retry = nil
+
+	if !accepted {
+		log.Printf("relay %s: AUTH rejected: %s", s.url, msg)
+		for _, id := range retry {
+			if sub, ok := s.subscriptions.remove(id); ok {
+				sub.end("auth-required: " + msg)
+			}
+		}
+		return true
+	}
+
+	log.Printf("relay %s: authenticated", s.url)
+
+	for _, id := range retry {
+		if sub, ok := s.subscriptions.get(id); ok {
+			err := s.refire(sub)
+			if err != nil {
+				s.fail("retry after auth", err)
+			}
+		}
+	}
+
+	return true
+}
+
+// Queue a subscription closed with auth-required for a retry once we are
+// authenticated. Returns false if auth is not allowed or the subscription
+// was already retried, in which case the caller should end it.
+func (s *Connection) retryAfterAuth(id string) bool {
+
+	if s.auth.sk == "" || s.auth.retried[id] {
+		return false
+	}
+
+	sub, ok := s.subscriptions.get(id)
+	if !ok {
+		return false
+	}
+
+	s.auth.retried[id] = true
+
+	// Already authenticated on this socket, the relay raced our AUTH.
+	if s.auth.authenticated {
+		err := s.refire(sub)
+		if err != nil {
+			s.fail("retry after auth", err)
+		}
+		return true
+	}
+
+	s.auth.retry = append(s.auth.retry, id)
+
+	// Relays may send the challenge before the CLOSED, answer it now.
+	if s.auth.pending == "" {
+		challenge := s.Challenge()
+		if challenge == "" {
+			// Wait for the relay to send one.
+			return true
+		}
+		err := s.authenticate(challenge)
+		if err != nil {
+			s.fail("auth", err)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long a cached entity is served as is before it is refreshed from
+// the relays in the background.
+const DefaultCacheTTL = 15 * time.Minute
+
+// Deadline for a background refresh, the request that started it may
+// have ended long before.
+const revalidateTimeout = time.Minute
+
+// Freshness keys of the cached entities.
+func profileKey(npub string) string  { return "profile:" + npub }
+func authorKey(pk string) string     { return "author:" + pk }
+func articleKey(naddr string) string { return "article:" + naddr }
+func hashtagKey(tag string) string   { return "hashtag:" + tag }
+
+// The read policy of the repository. The cached value is served right
+// away and refreshed from the relays in the background once it is older
+// than the TTL. When nothing is cached it is fetched before returning.
+// fetch stores what it pulls from the relays, read takes it from the
+// cache and reports whether it was there. The time of every successful
+// fetch is recorded under key.
+func cacheFirst[T any](ctx context.Context, s *Repository, key string, read func(context.Context) (T, bool, error), fetch func(context.Context) error) (T, error) {
+
+	var zero T
+
+	v, ok, err := read(ctx)
+	if err != nil {
+		return zero, err
+	}
+
+	if ok {
+		if s.stale(ctx, key) {
+			s.revalidate(key, fetch)
+		}
+		return v, nil
+	}
+
+	err = s.refresh(ctx, key, fetch)
+	if err != nil {
+		return zero, err
+	}
+
+	v, ok, err = read(ctx)
+	if err != nil {
+		return zero, err
+	}
+
+	if !ok {
+		return zero, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	return v, nil
+}
+
+// Fetch and record when the entity was refreshed.
+func (s *Repository) refresh(ctx context.Context, key string, fetch func(context.Context) error) error {
+
+	err := fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.db.touch(ctx, key, time.Now())
+}
+
+// Whether the entity was last refreshed longer than the TTL ago, or never.
+func (s *Repository) stale(ctx context.Context, key string) bool {
+
+	at, _, err := s.db.refreshedAt(ctx, key)
+	if err != nil {
+		log.Printf("freshness %s: %v", key, err)
+		return false
+	}
+
+	ttl := s.ttl
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	return time.Since(at) > ttl
+}
+
+// Refresh the entity in the background, once however many requests find
+// it stale at the same time.
+func (s *Repository) revalidate(key string, fetch func(context.Context) error) {
+
+	if s.revalidating == nil {
+		return
+	}
+
+	s.revalidating.start(key, func(ctx context.Context) error {
+		return s.refresh(ctx, key, fetch)
+	})
+}
+
+// Background refreshes in progress, by freshness key.
+type revalidator struct {
+	mu      sync.Mutex
+	running map[string]struct{}
+	wg      sync.WaitGroup
+}
+
+func newRevalidator() *revalidator {
+	return &revalidator{
+		running: make(map[string]struct{}),
+	}
+}
+
+func (s *revalidator) start(key string, fetch func(context.Context) error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.running[key]; ok {
+		return
+	}
+	s.running[key] = struct{}{}
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, key)
+			s.mu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+		defer cancel()
+
+		err := fetch(ctx)
+		if err != nil {
+			log.Printf("refresh %s: %v", key, err)
+		}
+	}()
+}
+
+// Block until the refreshes in progress are done.
+func (s *revalidator) wait() {
+	s.wg.Wait()
+}
+
+// When the entity was last refreshed from the relays, false if never.
+func (s *Db) refreshedAt(ctx context.Context, key string) (time.Time, bool, error) {
+
+	var at int64
+
+	err := s.DB.QueryRowContext(ctx, `SELECT refreshed_at FROM freshness WHERE entity = ?`, key).Scan(&at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(at, 0), true, nil
+}
+
+// Record that the entity was just refreshed from the relays.
+func (s *Db) touch(ctx context.Context, key string, at time.Time) error {
+
+	_, err := s.DB.ExecContext(ctx, `
+    INSERT INTO freshness (entity, refreshed_at) VALUES (?, ?)
+    ON CONFLICT (entity) DO UPDATE SET refreshed_at = excluded.refreshed_at
+    `, key, at.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
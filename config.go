@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/dextryz/nostr"
 )
@@ -16,6 +17,22 @@ type Config struct {
 	Profile    nostr.Profile     `json:"profile"`
 	Relays     map[string]string `json:"relays,omitempty"`
 	Following  map[string]Author `json:"following,omitempty"`
+
+	// Per relay settings keyed by the same address as Relays.
+	// Relays without an entry use the zero value.
+	RelayOptions map[string]RelayOptions `json:"relayoptions,omitempty"`
+
+	// Age after which cached entities are refreshed from the relays, as a
+	// Go duration such as "30m". Empty uses DefaultCacheTTL.
+	CacheTTL string `json:"cachettl,omitempty"`
+}
+
+type RelayOptions struct {
+	// Answer NIP-42 AUTH challenges from this relay with our private key.
+	Auth bool `json:"auth,omitempty"`
+
+	// Only read from this relay, never publish to it.
+	ReadOnly bool `json:"readonly,omitempty"`
 }
 
 type Author struct {
@@ -31,6 +48,8 @@ func NewConfig() *Config {
 		Profile:    nostr.Profile{},
 		Relays:     make(map[string]string),
 		Following:  make(map[string]Author),
+
+		RelayOptions: make(map[string]RelayOptions),
 	}
 }
 
@@ -59,6 +78,25 @@ func DecodeConfig(path string) (*Config, error) {
 	return config, nil
 }
 
+// Parsed CacheTTL, DefaultCacheTTL if unset.
+func (s *Config) TTL() (time.Duration, error) {
+
+	if s.CacheTTL == "" {
+		return DefaultCacheTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(s.CacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("cachettl: %w", err)
+	}
+
+	if ttl <= 0 {
+		return 0, fmt.Errorf("cachettl: %s is not positive", s.CacheTTL)
+	}
+
+	return ttl, nil
+}
+
 func (s *Config) AddRelay(relay string) {
 	s.Relays[relay] = relay
 }
@@ -1,78 +1,410 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dextryz/nostr"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// Delay before the first reconnect attempt after a relay drops.
+	reconnectBaseDelay = time.Second
+
+	// Upper bound on the delay between reconnect attempts.
+	reconnectMaxDelay = 2 * time.Minute
+)
+
+// Errors buffered on the error stream before further ones are only logged.
+const errBuffer = 64
+
+// Per relay counters, published on /debug/vars of the debug listener.
+var (
+	relayNotices = expvar.NewMap("relay_notices")
+	relayClosed  = expvar.NewMap("relay_closed")
+)
+
+// Give up on a relay handshake after this long, the default is 45 seconds.
+var dialer = websocket.Dialer{
+	Proxy:            websocket.DefaultDialer.Proxy,
+	HandshakeTimeout: 10 * time.Second,
+}
+
+var ErrNotConnected = errors.New("relay: socket not connected")
+var ErrConnectionClosed = errors.New("relay: connection closed")
+
+// Failure on a single relay connection. Callers can match the underlying
+// cause with errors.Is, and the relay and operation with errors.As.
+type RelayError struct {
+	Relay string
+	Op    string
+	Err   error
+}
+
+func (e *RelayError) Error() string {
+	return fmt.Sprintf("relay %s: %s: %v", e.Relay, e.Op, e.Err)
+}
+
+func (e *RelayError) Unwrap() error {
+	return e.Err
+}
+
 type Connection struct {
 
+	// Relay address used to dial and redial the socket.
+	url string
+
+	// Guards the socket, since the reader replaces it on reconnect while the writer uses it.
+	mu sync.Mutex
+
 	// Web socket connection between client and relay.
 	socket *websocket.Conn
 
+	// Never publish to this relay, see RelayOptions.
+	readOnly bool
+
+	// Last NIP-42 AUTH challenge sent by the relay. Guarded by mu.
+	challenge string
+
+	// NIP-42 state, see auth.go.
+	auth authState
+
+	// Cached NIP-11 document, nil until the first successful fetch.
+	info atomic.Pointer[RelayInfo]
+
+	// Set while the socket is up. Unhealthy relays are skipped by the repository.
+	healthy atomic.Bool
+
 	// The connection owns the subscriptions.
 	// Make a pointer, since we want to update the subscription event channel.
-	subscriptions map[string]*Subscription
+	subscriptions *registry
 
 	// Write events from channel to connected relays.
-	eventStream chan nostr.MessageEvent
+	eventStream chan outgoingEvent
 
 	// Write request from channel to connected relay socket.
 	reqStream chan nostr.MessageReq
 
-	okStream chan nostr.MessageOk
+	// Publishers waiting for an OK, keyed by event id.
+	acks *acks
+
+	// NIP-77 negentropy sessions waiting for the relay.
+	neg *negSessions
+
+	// Messages in the order they were read, waiting on verification.
+	verified chan *verifyJob
+
+	// Events dropped because they failed verification.
+	invalid atomic.Int64
+
+	// Write NIP-01 CLOSE for the subscription id to the relay socket.
+	closeStream chan string
+
+	// Asynchronous failures from the reader and writer goroutines.
+	errStream chan error
 
 	// Complete close connection
 	done chan struct{}
+
+	// Close tears down once.
+	closeOnce sync.Once
 }
 
 func NewConnection(addr string) *Connection {
+	return &Connection{
+		url:           addr,
+		subscriptions: newRegistry(),
+		eventStream:   make(chan outgoingEvent),
+		reqStream:     make(chan nostr.MessageReq),
+		acks:          newAcks(),
+		neg:           newNegSessions(),
+		verified:      make(chan *verifyJob, verifyBacklog),
+		closeStream:   make(chan string),
+		errStream:     make(chan error, errBuffer),
+		done:          make(chan struct{}),
+	}
+}
 
-	connection, _, err := websocket.DefaultDialer.Dial(addr, nil)
+func (s *Connection) Url() string {
+	return s.url
+}
+
+// Stop the repository from publishing to this relay. Call before Listen.
+func (s *Connection) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// Write relays receive events published through the repository.
+func (s *Connection) Writable() bool {
+	return !s.readOnly
+}
+
+// Number of subscriptions currently open on the connection.
+func (s *Connection) Subscriptions() int {
+	return s.subscriptions.len()
+}
+
+// A relay is healthy while its socket is connected.
+func (s *Connection) Healthy() bool {
+	return s.healthy.Load()
+}
+
+// NIP-11 document of the relay, nil if it has not been fetched (yet).
+func (s *Connection) Info() *RelayInfo {
+	return s.info.Load()
+}
+
+// Whether the relay advertises support for the NIP. Unknown relays are
+// assumed to support only the basics.
+func (s *Connection) Supports(nip int) bool {
+	info := s.Info()
+	return info != nil && info.Supports(nip)
+}
+
+// Largest limit the relay accepts in a filter, 0 if it does not say.
+func (s *Connection) MaxLimit() int {
+	info := s.Info()
+	if info == nil {
+		return 0
+	}
+	return info.Limitation.MaxLimit
+}
+
+// Most filters the relay accepts in one REQ, 0 if it does not say.
+func (s *Connection) MaxFilters() int {
+	info := s.Info()
+	if info == nil {
+		return 0
+	}
+	return info.Limitation.MaxFilters
+}
+
+// Fetch the NIP-11 document. A failure keeps the previous one.
+func (s *Connection) loadInfo() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), relayInfoTimeout)
+	defer cancel()
+
+	info, err := fetchRelayInfo(ctx, s.url)
 	if err != nil {
-		log.Fatal("websocket dial: ", err)
+		s.fail("relay information", err)
+		return
 	}
 
-	return &Connection{
-		socket:        connection,
-		subscriptions: make(map[string]*Subscription),
-		eventStream:   make(chan nostr.MessageEvent),
-		reqStream:     make(chan nostr.MessageReq),
-		okStream:      make(chan nostr.MessageOk),
-		done:          make(chan struct{}),
+	s.info.Store(info)
+}
+
+// Refresh the NIP-11 document every relayInfoTTL until the connection is
+// closed.
+func (s *Connection) refreshInfo() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(relayInfoTTL):
+		}
+
+		s.loadInfo()
 	}
 }
 
+// Errors raised in the background while reading from or writing to the
+// relay. The connection keeps running after sending one.
+func (s *Connection) Errors() <-chan error {
+	return s.errStream
+}
+
+// Report a background failure on the error stream without blocking.
+func (s *Connection) fail(op string, err error) {
+
+	e := &RelayError{Relay: s.url, Op: op, Err: err}
+
+	select {
+	case s.errStream <- e:
+	default:
+		log.Println(e)
+	}
+}
+
+// Dial the relay and swap in the new socket.
+func (s *Connection) dial() error {
+
+	socket, _, err := dialer.Dial(s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+
+	// Closed while dialing, Close has already released the old socket.
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		socket.Close()
+		return ErrConnectionClosed
+	default:
+	}
+
+	// The socket that failed, released before it is replaced.
+	if s.socket != nil {
+		s.socket.Close()
+	}
+
+	s.socket = socket
+	// A challenge is only valid for the socket it was sent on.
+	s.challenge = ""
+	s.auth.reset()
+	s.mu.Unlock()
+
+	s.healthy.Store(true)
+
+	return nil
+}
+
+func (s *Connection) conn() *websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.socket
+}
+
+// Write a raw message to the socket. Gorilla allows only one concurrent writer.
+func (s *Connection) writeMessage(bytes []byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.socket == nil || !s.healthy.Load() {
+		return ErrNotConnected
+	}
+
+	return s.socket.WriteMessage(websocket.TextMessage, bytes)
+}
+
+// Exponential backoff with jitter, so a relay coming back up is not hit by
+// every client at the same instant.
+func backoff(attempt int) time.Duration {
+
+	d := reconnectMaxDelay
+	if attempt < 16 && reconnectBaseDelay<<attempt < reconnectMaxDelay {
+		d = reconnectBaseDelay << attempt
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Redial the relay until it succeeds or the connection is closed.
+// Returns false if the connection was closed while waiting.
+func (s *Connection) reconnect() bool {
+
+	for attempt := 0; ; attempt++ {
+
+		select {
+		case <-s.done:
+			return false
+		case <-time.After(backoff(attempt)):
+		}
+
+		err := s.dial()
+		if errors.Is(err, ErrConnectionClosed) {
+			return false
+		}
+		if err != nil {
+			s.fail(fmt.Sprintf("reconnect attempt %d", attempt+1), err)
+			continue
+		}
+
+		log.Printf("relay %s: reconnected", s.url)
+
+		if s.Info() == nil {
+			s.loadInfo()
+		}
+
+		s.resubscribe()
+
+		return true
+	}
+}
+
+// Re-issue the REQ of every open subscription on a fresh socket.
+func (s *Connection) resubscribe() {
+
+	for _, sub := range s.subscriptions.all() {
+		err := s.refire(sub)
+		if err != nil {
+			s.fail("resubscribe", err)
+		}
+	}
+}
+
+// Write the REQ of a registered subscription straight to the socket.
+// Used from the reader goroutine, which must not wait on the writer.
+func (s *Connection) refire(sub *Subscription) error {
+
+	bytes, err := json.Marshal(nostr.MessageReq{
+		SubscriptionId: sub.GetId(),
+		Filters:        sub.resumeFilters(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.writeMessage(bytes)
+}
+
 // Listen to incoming events from remote relays by reading from socket.
-// The caller should run this method in a goroutine.
+// If the relay cannot be reached the connection keeps retrying in the
+// background and stays unhealthy until it succeeds.
 func (s *Connection) Listen() error {
 
+	err := s.dial()
+	if err != nil {
+		s.fail("dial", err)
+	}
+
+	// Queries are clamped to max_limit and pick NIP-77 by the document, so
+	// it is loaded before the connection is handed out. A relay that is
+	// down gets it once it reconnects.
+	if err == nil {
+		s.loadInfo()
+	}
+
+	go s.refreshInfo()
+
+	// Hand verified events to their subscriptions.
+	go s.deliver()
+
 	// Listen to requests on the reqStream that should be broadcasted to relays.
 	go func() {
 		for {
 			select {
 			case <-s.done:
 				return
-			case event := <-s.eventStream:
+			case out := <-s.eventStream:
 
 				//log.Println("Writing event to relays")
 
 				// Marshal the signed event to a slice of bytes ready for transmission.
-				bytes, err := json.Marshal(event)
-				if err != nil {
-					log.Fatalf("\nunable to marshal incoming EVENT: %#v", err)
-				}
+				bytes, err := json.Marshal(out.event)
 
 				// Transmit event message to the spoke that connects to the relays.
-				err = s.socket.WriteMessage(websocket.TextMessage, bytes)
-				if err != nil {
-					// TODO: add an error channel pattern
-					log.Fatalln(err)
+				if err == nil {
+					err = s.writeMessage(bytes)
 				}
 
+				// The publisher reports a failed write instead of waiting
+				// for an OK that never comes.
+				out.result <- err
+
 			case req := <-s.reqStream:
 
 				log.Printf("REQ sent to relays: %#v", req)
@@ -80,16 +412,31 @@ func (s *Connection) Listen() error {
 				// Marshal to a slice of bytes ready for transmission.
 				bytes, err := json.Marshal(req)
 				if err != nil {
-					log.Fatalf("\nunable to marshal incoming REQ: %#v", err)
+					s.fail("marshal REQ", err)
+					continue
 				}
 
 				// Transmit event message to the spoke that connects to the relays.
-				err = s.socket.WriteMessage(websocket.TextMessage, bytes)
+				// A dropped REQ is re-issued once the reader has reconnected.
+				err = s.writeMessage(bytes)
 				if err != nil {
-					// TODO: add an error channel pattern
-					log.Fatalln(err)
+					s.fail("write REQ", err)
 				}
 
+			case id := <-s.closeStream:
+
+				bytes, err := json.Marshal([]string{"CLOSE", id})
+				if err != nil {
+					s.fail("marshal CLOSE", err)
+					continue
+				}
+
+				// Nothing more to do if this fails, the relay forgets the
+				// subscription when the socket drops anyway.
+				err = s.writeMessage(bytes)
+				if err != nil {
+					s.fail("write CLOSE", err)
+				}
 			}
 		}
 	}()
@@ -98,33 +445,72 @@ func (s *Connection) Listen() error {
 	go func() {
 		for {
 
+			if !s.Healthy() && !s.reconnect() {
+				return
+			}
+
 			// Block for a status response from relays
-			_, raw, err := s.socket.ReadMessage()
+			_, raw, err := s.conn().ReadMessage()
 			if err != nil {
-				log.Fatalln(err)
+
+				select {
+				case <-s.done:
+					return
+				default:
+				}
+
+				s.healthy.Store(false)
+				s.fail("read", err)
+				continue
+			}
+
+			label, fields, err := decodeEnvelope(raw)
+			if err != nil {
+				s.fail("decode", err)
+				continue
+			}
+
+			// Messages the nostr package does not decode.
+			switch label {
+			case "NOTICE":
+				s.handleNotice(fields)
+				continue
+			case "CLOSED":
+				s.handleClosed(fields)
+				continue
+			case "AUTH":
+				s.handleAuth(fields)
+				continue
+			case "OK":
+				if !s.handleAuthOk(fields) {
+					s.handleOk(fields)
+				}
+				continue
+			case "NEG-MSG", "NEG-ERR":
+				s.handleNeg(label, fields)
+				continue
 			}
 
 			msg := nostr.DecodeMessage(raw)
+			if msg == nil {
+				continue
+			}
 
 			switch msg.Type() {
 			case "EVENT":
-				// Dispatch event to inmem subscription channel.
+				// Verify the event, then dispatch it to the inmem subscription channel.
 				m := msg.(*nostr.MessageEvent)
-				if sub, ok := s.subscriptions[m.GetSubId()]; ok {
-					sub.EventStream <- &m.Event
+				if sub, ok := s.subscriptions.get(m.GetSubId()); ok {
+					s.verify(sub, subMessage{event: &m.Event})
 				}
-				// Show relay response status after publishing an event.
-			case "OK":
-				ok := msg.(*nostr.MessageOk)
-				s.okStream <- *ok
 			// Close is end of new events.
 			case "EOSE":
 
 				m := msg.(*nostr.MessageEose)
 
-				// Dispatch event to inmem subscription channel.
-				if sub, ok := s.subscriptions[m.GetSubId()]; ok {
-					sub.Done <- struct{}{}
+				// Dispatch after the events read before it.
+				if sub, ok := s.subscriptions.get(m.GetSubId()); ok {
+					s.verify(sub, subMessage{eose: true})
 				}
 			}
 		}
@@ -135,67 +521,319 @@ func (s *Connection) Listen() error {
 	return nil
 }
 
-// Publish events to remote relays.
-// Sign event before publishing
-func (s *Connection) Publish(event nostr.Event, sk string) (*nostr.MessageOk, error) {
+// Event handed to the writer, with where to report whether it was sent.
+type outgoingEvent struct {
+	event nostr.MessageEvent
 
-	// TODO: Maybe fix this
+	// Buffered, so the writer never waits on a publisher that gave up.
+	result chan error
+}
 
-	pub, err := nostr.GetPublicKey(sk)
-	if err != nil {
-		return nil, err
-	}
+// Relay response to a published event: ["OK", <event id>, <accepted>, <message>]
+type Ack struct {
+	Accepted bool
+	Message  string
+}
 
-	// Add original author to event.
-	event.PubKey = pub
+// Publishers waiting for an OK. Safe for concurrent use, so acks for one
+// publisher are never consumed by another.
+type acks struct {
+	mu      sync.Mutex
+	waiting map[string][]chan Ack
+}
 
-	// We have to sign last, since the signature is dependent on the event content.
-	event.Sign(sk)
+func newAcks() *acks {
+	return &acks{
+		waiting: make(map[string][]chan Ack),
+	}
+}
 
-	go func() {
-		s.eventStream <- nostr.MessageEvent{
-			Event: event,
+// Register interest in the OK for an event id. Must be called before the
+// event is sent, so a fast relay cannot answer before we listen.
+func (s *acks) wait(id string) chan Ack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan Ack, 1)
+	s.waiting[id] = append(s.waiting[id], ch)
+	return ch
+}
+
+func (s *acks) forget(id string, ch chan Ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting := s.waiting[id]
+	for i, c := range waiting {
+		if c == ch {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
 		}
-	}()
+	}
+	if len(waiting) == 0 {
+		delete(s.waiting, id)
+	} else {
+		s.waiting[id] = waiting
+	}
+}
 
-	for {
+// Hand the OK to everyone waiting on the event. Returns false if nobody was.
+func (s *acks) deliver(id string, ack Ack) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting := s.waiting[id]
+	for _, ch := range waiting {
+		// Buffered with room for exactly one OK, never blocks the reader.
 		select {
-		case <-s.done:
-			return nil, nil
-		case msg := <-s.okStream:
-			if msg.GetEventId() == event.GetId() {
-				return &msg, nil
-			}
+		case ch <- ack:
+		default:
+		}
+	}
+	return len(waiting) > 0
+}
+
+func (s *Connection) handleOk(fields []json.RawMessage) {
+
+	if len(fields) < 2 {
+		s.fail("decode OK", errors.New("missing fields"))
+		return
+	}
+
+	var id string
+	var ack Ack
+
+	json.Unmarshal(fields[0], &id)
+	json.Unmarshal(fields[1], &ack.Accepted)
+	if len(fields) > 2 {
+		json.Unmarshal(fields[2], &ack.Message)
+	}
+
+	if !s.acks.deliver(id, ack) {
+		log.Printf("relay %s: nobody waiting for OK on %s, dropped", s.url, id)
+	}
+}
+
+// Publish a signed event to the relay and wait for its OK, until ctx is done.
+func (s *Connection) Publish(ctx context.Context, event nostr.Event) (*Ack, error) {
+
+	if !s.Healthy() {
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ErrNotConnected}
+	}
+
+	ch := s.acks.wait(event.Id)
+	defer s.acks.forget(event.Id, ch)
+
+	out := outgoingEvent{
+		event:  nostr.MessageEvent{Event: event},
+		result: make(chan error, 1),
+	}
+
+	select {
+	case s.eventStream <- out:
+	case <-ctx.Done():
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ctx.Err()}
+	case <-s.done:
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ErrConnectionClosed}
+	}
+
+	select {
+	case err := <-out.result:
+		if err != nil {
+			return nil, &RelayError{Relay: s.url, Op: "publish", Err: err}
 		}
+	case <-ctx.Done():
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ctx.Err()}
+	case <-s.done:
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ErrConnectionClosed}
+	}
+
+	select {
+	case ack := <-ch:
+		return &ack, nil
+	case <-ctx.Done():
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ctx.Err()}
+	case <-s.done:
+		return nil, &RelayError{Relay: s.url, Op: "publish", Err: ErrConnectionClosed}
 	}
 }
 
 func (s *Connection) Subscribe(filters nostr.Filters) (*Subscription, error) {
+	return s.subscribe(filters, false)
+}
+
+// Subscribe without an end. Stored events are followed by newly published
+// ones until the subscription is closed, and Done is never signalled.
+// After a reconnect only events newer than the last one delivered are
+// requested again.
+func (s *Connection) SubscribeLive(filters nostr.Filters) (*Subscription, error) {
+	return s.subscribe(filters, true)
+}
+
+func (s *Connection) subscribe(filters nostr.Filters, live bool) (*Subscription, error) {
+
+	select {
+	case <-s.done:
+		return nil, &RelayError{Relay: s.url, Op: "subscribe", Err: ErrConnectionClosed}
+	default:
+	}
+
+	if !s.Healthy() {
+		return nil, &RelayError{Relay: s.url, Op: "subscribe", Err: ErrNotConnected}
+	}
+
+	if max := s.MaxFilters(); max > 0 && len(filters) > max {
+		return nil, &RelayError{Relay: s.url, Op: "subscribe", Err: fmt.Errorf("%d filters exceeds relay max_filters of %d", len(filters), max)}
+	}
 
 	// 1. Create a new subscription and take ownership
 
 	sub := NewSubscription()
+	sub.conn = s
+	sub.live = live
 
-	s.subscriptions[sub.GetId()] = sub
+	// Set before registering, the reader re-issues registered filters on reconnect.
+	sub.filters = filters
+
+	s.subscriptions.add(sub)
 
 	// 2. Fire a REQ to the relay.
 
 	err := sub.Fire(filters, s.reqStream)
 	if err != nil {
-		return nil, err
+		sub.Close()
+		return nil, &RelayError{Relay: s.url, Op: "subscribe", Err: err}
 	}
 
 	return sub, nil
 }
 
-// Disconnect from the WebSocket server
+// Hand a message to the subscriber. A subscriber that stopped reading is
+// closed instead of stalling the socket reader for every other subscription.
+func (s *Connection) dispatch(sub *Subscription, m subMessage) {
+
+	if sub.enqueue(m) {
+		return
+	}
+
+	log.Printf("relay %s: subscription %s is not reading, closing", s.url, sub.GetId())
+
+	s.unsubscribe(sub.GetId())
+	sub.end("slow consumer")
+}
+
+// Forget the subscription and send CLOSE to the relay.
+// Does nothing if the subscription has already ended.
+func (s *Connection) unsubscribe(id string) {
+
+	if _, ok := s.subscriptions.remove(id); !ok {
+		return
+	}
+
+	select {
+	case s.closeStream <- id:
+	case <-s.done:
+	}
+}
+
+// Human readable message from the relay: ["NOTICE", <message>]
+func (s *Connection) handleNotice(fields []json.RawMessage) {
+
+	var msg string
+	if len(fields) > 0 {
+		json.Unmarshal(fields[0], &msg)
+	}
+
+	relayNotices.Add(s.url, 1)
+
+	log.Printf("relay %s: NOTICE: %s", s.url, msg)
+}
+
+// Relay ended one of our subscriptions: ["CLOSED", <subid>, <reason>]
+func (s *Connection) handleClosed(fields []json.RawMessage) {
+
+	var id, reason string
+	if len(fields) > 0 {
+		json.Unmarshal(fields[0], &id)
+	}
+	if len(fields) > 1 {
+		json.Unmarshal(fields[1], &reason)
+	}
+
+	relayClosed.Add(s.url, 1)
+
+	// Keep the subscription and retry it once we have authenticated.
+	if strings.HasPrefix(reason, "auth-required:") && s.retryAfterAuth(id) {
+		return
+	}
+
+	if sub, ok := s.subscriptions.remove(id); ok {
+		log.Printf("relay %s: subscription %s closed: %s", s.url, id, reason)
+		sub.end(reason)
+	}
+}
+
+// Latest NIP-42 challenge sent by the relay, empty if none.
+func (s *Connection) Challenge() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.challenge
+}
+
+// Split a relay message into its label and remaining elements.
+// The nostr package only decodes EVENT, OK and EOSE.
+func decodeEnvelope(raw []byte) (string, []json.RawMessage, error) {
+
+	var fields []json.RawMessage
+
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(fields) == 0 {
+		return "", nil, errors.New("empty message")
+	}
+
+	var label string
+
+	err = json.Unmarshal(fields[0], &label)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return label, fields[1:], nil
+}
+
+// Disconnect from the WebSocket server. Safe to call more than once and
+// from any goroutine, the pool, its eviction and shutdown may all close the
+// same connection.
 func (s *Connection) Close() {
+	s.closeOnce.Do(s.close)
+}
+
+func (s *Connection) close() {
 	log.Println("Closing connection")
 
-	// TODO: Close all subscriptions before closing WS connection.
+	// Stop the reader and writer goroutines and any pending reconnect.
+	close(s.done)
+
+	// End all subscriptions before closing WS connection. The relay drops
+	// them with the socket, so there is no need to send CLOSE for each.
+	for _, sub := range s.subscriptions.all() {
+		s.subscriptions.remove(sub.GetId())
+		sub.end("connection closed")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.socket == nil {
+		return
+	}
 
 	err := s.socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
 		log.Println("write close:", err)
 	}
+
+	s.socket.Close()
+	s.healthy.Store(false)
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+func TestConnectionSubscribe(t *testing.T) {
+
+	r := testRelay(t,
+		signedEvent(t, 1, "first", 100),
+		signedEvent(t, 1, "second", 200),
+		signedEvent(t, 7, "+", 300),
+	)
+	c := testConnection(t, r)
+
+	sub, err := c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := drain(t, sub)
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2", len(got))
+	}
+
+	sub.Close()
+
+	eventually(t, "CLOSE sent", func() bool {
+		return r.Subscriptions() == 0
+	})
+}
+
+func TestConnectionInvalidEvent(t *testing.T) {
+
+	e := signedEvent(t, 1, "note", 100)
+	e.Content = "tampered"
+
+	r := testRelay(t, e, signedEvent(t, 1, "valid", 200))
+	c := testConnection(t, r)
+
+	sub, err := c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	got := drain(t, sub)
+	if len(got) != 1 || got[0].Content != "valid" {
+		t.Fatalf("got %v, want only the valid event", got)
+	}
+}
+
+func TestConnectionReconnect(t *testing.T) {
+
+	r := testRelay(t, signedEvent(t, 1, "note", 100))
+	c := testConnection(t, r)
+
+	r.Disconnect()
+
+	eventually(t, "reconnect", func() bool {
+		return c.Healthy() && r.Clients() == 1
+	})
+
+	sub, err := c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	got := drain(t, sub)
+	if len(got) != 1 {
+		t.Fatalf("got %d events, want 1", len(got))
+	}
+}
+
+func TestConnectionClosedWhileReconnecting(t *testing.T) {
+
+	r := testRelay(t, signedEvent(t, 1, "note", 100))
+
+	c := NewConnection(r.URL)
+
+	err := c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.Disconnect()
+		eventually(t, "reconnect", func() bool {
+			return c.Healthy() && r.Clients() == 1
+		})
+	}
+
+	r.Disconnect()
+	c.Close()
+
+	// A redial racing Close must not leave a socket behind.
+	time.Sleep(time.Second)
+
+	if r.Clients() != 0 {
+		t.Fatalf("%d sockets open after Close", r.Clients())
+	}
+}
+
+func TestConnectionCloseTwice(t *testing.T) {
+
+	r := testRelay(t)
+
+	c := NewConnection(r.URL)
+
+	err := c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestConnectionInfo(t *testing.T) {
+
+	r := testRelay(t)
+	r.SetInfo(map[string]any{
+		"name":           "test relay",
+		"supported_nips": []int{1, 11, 50},
+		"limitation": map[string]any{
+			"max_limit":   2,
+			"max_filters": 1,
+		},
+	})
+
+	// The document is loaded by the time Listen returns.
+	c := testConnection(t, r)
+
+	if c.Info() == nil || c.Info().Name != "test relay" {
+		t.Fatalf("info %+v", c.Info())
+	}
+
+	if c.MaxLimit() != 2 || !c.Supports(50) || c.Supports(77) {
+		t.Fatalf("limits not taken from the document: %+v", c.Info())
+	}
+
+	_, err := c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}, {Kinds: []uint32{7}}})
+
+	var relayErr *RelayError
+	if !errors.As(err, &relayErr) {
+		t.Fatalf("got %v, want a RelayError for exceeding max_filters", err)
+	}
+}
+
+func TestConnectionPublish(t *testing.T) {
+
+	r := testRelay(t)
+	c := testConnection(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ack, err := c.Publish(ctx, signedEvent(t, 1, "hello", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ack.Accepted {
+		t.Fatalf("not accepted: %s", ack.Message)
+	}
+
+	if len(r.Events()) != 1 {
+		t.Fatalf("relay holds %d events, want 1", len(r.Events()))
+	}
+
+	r.SetReject("blocked: test")
+
+	ack, err = c.Publish(ctx, signedEvent(t, 1, "again", 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack.Accepted || ack.Message != "blocked: test" {
+		t.Fatalf("got %+v, want rejected", ack)
+	}
+}
+
+func TestConnectionAuth(t *testing.T) {
+
+	r := testRelay(t, signedEvent(t, 1, "members only", 100))
+	r.RequireAuth("challenge")
+
+	anonymous := testConnection(t, r)
+
+	sub, err := anonymous.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sub.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("REQ without auth not closed")
+	}
+
+	c := NewConnection(r.URL)
+	c.EnableAuth(testSk)
+
+	err = c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	eventually(t, "challenge", func() bool {
+		return c.Challenge() == "challenge"
+	})
+
+	sub, err = c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	got := drain(t, sub)
+	if len(got) != 1 {
+		t.Fatalf("got %d events, want 1", len(got))
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Edit distance beyond which two versions are shown as one replacement,
+// the diff would be unreadable and expensive anyway.
+const maxDiffEdits = 1000
+
+type diffKind int
+
+const (
+	diffEqual diffKind = iota
+	diffInsert
+	diffDelete
+)
+
+type diffOp struct {
+	kind diffKind
+	text string
+}
+
+// Split into alternating runs of whitespace and other characters, so the
+// tokens join back into the original text.
+func words(s string) []string {
+
+	tokens := []string{}
+
+	start := 0
+	space := false
+
+	for i, r := range s {
+		isSpace := unicode.IsSpace(r)
+		if i > 0 && isSpace != space {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		space = isSpace
+	}
+
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+
+	return tokens
+}
+
+// Word level diff of two texts, consecutive operations of the same kind
+// merged.
+func diffWords(a, b string) []diffOp {
+
+	x, y := words(a), words(b)
+
+	// Edits are usually local, so match the common ends first.
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	ops := []diffOp{}
+	ops = appendOps(ops, diffEqual, x[:prefix])
+	ops = append(ops, myers(x[prefix:len(x)-suffix], y[prefix:len(y)-suffix])...)
+	ops = appendOps(ops, diffEqual, x[len(x)-suffix:])
+
+	return merge(ops)
+}
+
+// Shortest edit script between two token lists (Myers, 1986). Falls back
+// to deleting all of x and inserting all of y past maxDiffEdits.
+func myers(x, y []string) []diffOp {
+
+	n, m := len(x), len(y)
+
+	if n == 0 || m == 0 {
+		ops := appendOps(nil, diffDelete, x)
+		return appendOps(ops, diffInsert, y)
+	}
+
+	limit := min(n+m, maxDiffEdits)
+
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+
+	// Furthest x reached on each diagonal k = x - y, after each d.
+	trace := [][]int{}
+
+	for d := 0; d <= limit; d++ {
+
+		for k := -d; k <= d; k += 2 {
+
+			var i int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				i = v[offset+k+1]
+			} else {
+				i = v[offset+k-1] + 1
+			}
+
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+
+			v[offset+k] = i
+
+			if i >= n && j >= m {
+				trace = append(trace, append([]int{}, v...))
+				return backtrack(x, y, trace, offset)
+			}
+		}
+
+		trace = append(trace, append([]int{}, v...))
+	}
+
+	ops := appendOps(nil, diffDelete, x)
+	return appendOps(ops, diffInsert, y)
+}
+
+// Walk the trace from the end to recover the edits, then reverse them.
+func backtrack(x, y []string, trace [][]int, offset int) []diffOp {
+
+	ops := []diffOp{}
+
+	i, j := len(x), len(y)
+
+	for d := len(trace) - 1; d > 0; d-- {
+
+		v := trace[d-1]
+		k := i - j
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevI := v[offset+prevK]
+		prevJ := prevI - prevK
+
+		for i > prevI && j > prevJ {
+			i--
+			j--
+			ops = append(ops, diffOp{diffEqual, x[i]})
+		}
+
+		if i == prevI {
+			j--
+			ops = append(ops, diffOp{diffInsert, y[j]})
+		} else {
+			i--
+			ops = append(ops, diffOp{diffDelete, x[i]})
+		}
+	}
+
+	for i > 0 && j > 0 {
+		i--
+		j--
+		ops = append(ops, diffOp{diffEqual, x[i]})
+	}
+
+	for l, r := 0, len(ops)-1; l < r; l, r = l+1, r-1 {
+		ops[l], ops[r] = ops[r], ops[l]
+	}
+
+	return ops
+}
+
+func appendOps(ops []diffOp, kind diffKind, tokens []string) []diffOp {
+	for _, t := range tokens {
+		ops = append(ops, diffOp{kind, t})
+	}
+	return ops
+}
+
+func merge(ops []diffOp) []diffOp {
+
+	merged := []diffOp{}
+
+	for _, op := range ops {
+		if n := len(merged); n > 0 && merged[n-1].kind == op.kind {
+			merged[n-1].text += op.text
+			continue
+		}
+		merged = append(merged, op)
+	}
+
+	return merged
+}
+
+// Diff as HTML, removed words in <del> and added ones in <ins>.
+func diffHtml(ops []diffOp) string {
+
+	var b strings.Builder
+
+	for _, op := range ops {
+
+		text := html.EscapeString(op.text)
+
+		switch op.kind {
+		case diffEqual:
+			b.WriteString(text)
+		case diffInsert:
+			b.WriteString("<ins>" + text + "</ins>")
+		case diffDelete:
+			b.WriteString("<del>" + text + "</del>")
+		}
+	}
+
+	return b.String()
+}
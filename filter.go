@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dextryz/nostr"
+)
+
+// Only the newest version of a replaceable event is returned, as relays
+// keep only that one. Kinds 0, 3 and 10000 to 19999 are replaced per
+// author and kind, 30000 to 39999 per d tag as well.
+const currentVersionSQL = `
+    (e.kind NOT IN (0, 3) AND NOT (e.kind >= 10000 AND e.kind < 20000) AND NOT (e.kind >= 30000 AND e.kind < 40000))
+    OR NOT EXISTS (
+        SELECT 1 FROM event n
+        WHERE n.pubkey = e.pubkey AND n.kind = e.kind AND IFNULL(n.d_tag, '') = IFNULL(e.d_tag, '')
+        AND (n.created_at > e.created_at OR (n.created_at = e.created_at AND n.id < e.id))
+    )`
+
+// Answer a NIP-01 filter from the cached events, newest first, the way a
+// relay would. Ids, authors, kinds, single letter tags and since/until are
+// matched, and the limit is capped at QueryLimit. Search is not, see
+// QueryArticles.
+func (s *Db) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+
+	err := s.checkLimits(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	where := []string{"(" + currentVersionSQL + ")"}
+	args := []any{}
+
+	in := func(column string, values []string) {
+		where = append(where, column+" IN ("+placeholders(len(values))+")")
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+
+	// An empty list matches nothing, a missing one everything.
+	if filter.Ids != nil {
+		in("e.id", filter.Ids)
+	}
+
+	if filter.Authors != nil {
+		in("e.pubkey", filter.Authors)
+	}
+
+	if filter.Kinds != nil {
+		where = append(where, "e.kind IN ("+placeholders(len(filter.Kinds))+")")
+		for _, k := range filter.Kinds {
+			args = append(args, k)
+		}
+	}
+
+	for name, values := range filter.Tags {
+
+		name = strings.TrimPrefix(name, "#")
+
+		where = append(where, "e.id IN (SELECT event_id FROM event_tag WHERE name = ? AND value IN ("+placeholders(len(values))+"))")
+		args = append(args, name)
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+
+	if filter.Since != nil {
+		where = append(where, "e.created_at >= ?")
+		args = append(args, int64(*filter.Since))
+	}
+
+	if filter.Until != nil {
+		where = append(where, "e.created_at <= ?")
+		args = append(args, int64(*filter.Until))
+	}
+
+	limit := s.QueryLimit
+	if filter.Limit > 0 && filter.Limit < limit {
+		limit = filter.Limit
+	}
+	args = append(args, limit)
+
+	query := `SELECT e.raw FROM event e WHERE ` + strings.Join(where, " AND ") + ` ORDER BY e.created_at DESC, e.id ASC LIMIT ?`
+
+	return scanEvents(ctx, s.DB, query, args...)
+}
+
+// Reject filters that would fan out into too many lookups.
+func (s *Db) checkLimits(filter nostr.Filter) error {
+
+	if len(filter.Ids) > s.QueryIdLimit {
+		return fmt.Errorf("requested articles exceeds ID limit of %d", s.QueryIdLimit)
+	}
+
+	if len(filter.Authors) > s.QueryAuthorLimit {
+		return fmt.Errorf("authors exceeds limit of %d", s.QueryAuthorLimit)
+	}
+
+	for _, tags := range filter.Tags {
+		if len(tags) > s.QueryTagLimit {
+			return fmt.Errorf("tags exceeds limit of %d", s.QueryTagLimit)
+		}
+	}
+
+	return nil
+}
+
+// Cached articles matching the filter, the current version of each. Kinds
+// default to NIP-23 articles. With a search term the articles are ranked
+// by SearchArticles, otherwise they are newest first.
+func (s *Db) QueryArticles(ctx context.Context, filter nostr.Filter) ([]*Article, error) {
+
+	if filter.Kinds == nil {
+		filter.Kinds = []uint32{nostr.KindArticle}
+	}
+
+	search := filter.Search
+	filter.Search = ""
+
+	// Ranked matches are narrowed down by the rest of the filter below, so
+	// the limit only applies after that.
+	limit := filter.Limit
+	if search != "" {
+		filter.Limit = 0
+	}
+
+	events, err := s.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	tags := make(map[string][]string)
+
+	for _, e := range events {
+
+		if e.Kind != nostr.KindArticle {
+			continue
+		}
+
+		naddr, err := EncodeAddress(e.PubKey, e.Kind, identifier(e))
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, naddr)
+
+		// The article row does not carry its hashtags.
+		tags[naddr] = []string{}
+		for _, t := range e.Tags {
+			if t.Key() == "t" {
+				tags[naddr] = append(tags[naddr], t.Value())
+			}
+		}
+	}
+
+	if search != "" {
+
+		hits, err := s.SearchArticles(ctx, search, s.QueryLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		ranked := []string{}
+		for _, hit := range hits {
+			if _, ok := tags[hit.Article.Id]; ok {
+				ranked = append(ranked, hit.Article.Id)
+			}
+		}
+
+		if limit > 0 && len(ranked) > limit {
+			ranked = ranked[:limit]
+		}
+
+		ids = ranked
+	}
+
+	rows, err := s.queryArticlesById(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	articles := []*Article{}
+
+	for _, id := range ids {
+		a, ok := rows[id]
+		if !ok {
+			continue
+		}
+		a.HashTags = tags[id]
+		articles = append(articles, a)
+	}
+
+	return articles, nil
+}
+
+// Article rows by naddr.
+func (s *Db) queryArticlesById(ctx context.Context, ids []string) (map[string]*Article, error) {
+
+	articles := make(map[string]*Article)
+
+	if len(ids) == 0 {
+		return articles, nil
+	}
+
+	args := []any{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `
+        SELECT article_id, image, title, summary, md_content, html_content, published_at
+        FROM article WHERE article_id IN (`+placeholders(len(ids))+`)
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Article
+		err := rows.Scan(&a.Id, &a.Image, &a.Title, &a.Summary, &a.MdContent, &a.HtmlContent, &a.PublishedAt)
+		if err != nil {
+			return nil, err
+		}
+		articles[a.Id] = &a
+	}
+
+	return articles, rows.Err()
+}
+
+// Parameter list for an IN clause, an empty list matches nothing.
+func placeholders(n int) string {
+
+	if n == 0 {
+		return "NULL"
+	}
+
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/dextryz/nostr"
 	"github.com/gorilla/mux"
@@ -14,12 +23,48 @@ import (
 type Note struct {
 	Article *Article
 	Profile *Profile
+
+	// Highlighted excerpt when the card is a search result.
+	Snippet string
 }
 
 type Handler struct {
 	repository Repository
 }
 
+// 32 bytes in hex, as NIP-01 event ids and pubkeys are.
+func isHex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Translate repository and relay errors into HTTP error responses, so a bad
+// relay or event fails the request instead of the server.
+func httpError(w http.ResponseWriter, err error) {
+
+	status := http.StatusInternalServerError
+
+	var relayErr *RelayError
+
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, sql.ErrNoRows):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalidEntity), errors.Is(err, ErrNotList):
+		status = http.StatusBadRequest
+	case errors.As(err, &relayErr):
+		status = http.StatusBadGateway
+	case errors.Is(err, ErrNoFTS5):
+		status = http.StatusNotImplemented
+	}
+
+	log.Println(err)
+
+	http.Error(w, err.Error(), status)
+}
+
 func (s *Handler) Home(w http.ResponseWriter, r *http.Request) {
 
 	tmpl, err := template.ParseFiles("static/index.html", "static/card.html")
@@ -42,9 +87,9 @@ func (s *Handler) Tag(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hashtag := vars["ht"]
 
-	articles, err := s.repository.ArticleByTag(hashtag)
+	articles, err := s.repository.ArticleByTag(r.Context(), hashtag)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -52,10 +97,9 @@ func (s *Handler) Tag(w http.ResponseWriter, r *http.Request) {
 
 	for _, a := range articles {
 
-		p, err := s.repository.ProfileByArticle(a.Id)
+		p, err := s.repository.ProfileByArticle(r.Context(), a.Id)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, err)
 			return
 		}
 
@@ -73,7 +117,141 @@ func (s *Handler) Tag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl.Execute(w, cards)
+	tmpl.Execute(w, &TagPage{
+		Tag:   hashtag,
+		Cards: cards,
+	})
+}
+
+type TagPage struct {
+	Tag   string
+	Cards []*Note
+}
+
+type SearchPage struct {
+	Query string
+	Cards []*Note
+}
+
+// Full-text search over the cached articles, ranked cards with the
+// matching excerpt.
+func (s *Handler) Search(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query().Get("q")
+
+	cards, err := s.repository.Search(r.Context(), query)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("static/search.html", "static/card.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.ExecuteTemplate(w, "search.html", &SearchPage{
+		Query: query,
+		Cards: cards,
+	})
+	if err != nil {
+		log.Printf("search: %v", err)
+	}
+}
+
+// Stream articles newly published with the hashtag to the tag page.
+func (s *Handler) LiveTag(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	f := nostr.Filter{
+		Tags: map[string][]string{"t": {vars["ht"]}},
+	}
+
+	s.live(w, r, f, "static/taglist.html", "tagcards")
+}
+
+// Stream articles newly published by the authors to the card list of
+// ListEvents. Authors are hex pubkeys separated by commas.
+func (s *Handler) LiveEvents(w http.ResponseWriter, r *http.Request) {
+
+	authors := []string{}
+
+	for _, pk := range strings.Split(r.URL.Query().Get("authors"), ",") {
+		if isHex(pk) {
+			authors = append(authors, pk)
+		}
+	}
+
+	if len(authors) == 0 {
+		httpError(w, fmt.Errorf("%w: no authors to follow", ErrInvalidEntity))
+		return
+	}
+
+	f := nostr.Filter{
+		Authors: authors,
+	}
+
+	s.live(w, r, f, "static/card.html", "events")
+}
+
+// Send every new article matching f as a server-sent "article" event, the
+// card rendered with the named template, until the client disconnects.
+func (s *Handler) live(w http.ResponseWriter, r *http.Request, f nostr.Filter, file, name string) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	notes := s.repository.LiveArticles(r.Context(), f)
+
+	// Comment lines keep proxies from closing an idle stream.
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case n, ok := <-notes:
+			if !ok {
+				return
+			}
+
+			var buf bytes.Buffer
+			err := tmpl.ExecuteTemplate(&buf, name, []*Note{n})
+			if err != nil {
+				log.Printf("live: %v", err)
+				continue
+			}
+
+			// Every line of the payload needs its own data field.
+			fmt.Fprint(w, "event: article\n")
+			for _, line := range strings.Split(buf.String(), "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+		}
+
+		flusher.Flush()
+	}
 }
 
 // 1. Pull lists
@@ -85,13 +263,18 @@ func (s *Handler) Tag(w http.ResponseWriter, r *http.Request) {
 func (s *Handler) Profile(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
-	pubkey := vars["npub"]
 
-	log.Printf("Pulling profile with npub: %s", pubkey)
+	s.profile(w, r, vars["npub"])
+}
+
+// Render the profile page for an npub or nprofile.
+func (s *Handler) profile(w http.ResponseWriter, r *http.Request, nid string) {
+
+	log.Printf("Pulling profile with npub: %s", nid)
 
-	profile, err := s.repository.Profile(pubkey)
+	profile, err := s.repository.Profile(r.Context(), nid)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -107,11 +290,17 @@ func (s *Handler) Profile(w http.ResponseWriter, r *http.Request) {
 func (s *Handler) Article(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
-	id := vars["nid"]
 
-	article, err := s.repository.Article(id)
+	s.article(w, r, vars["nid"])
+}
+
+// Render the current version of the article named by an naddr, or by the
+// note, nevent or hex id of one of its versions.
+func (s *Handler) article(w http.ResponseWriter, r *http.Request, nid string) {
+
+	article, err := s.repository.Article(r.Context(), nid)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -124,13 +313,194 @@ func (s *Handler) Article(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, article)
 }
 
+// Page for any NIP-19 entity or hex event id, so shared nostr links can
+// be opened by replacing the host. Events that are not articles, such as
+// notes and lists, are served as signed.
+func (s *Handler) Entity(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	entity, err := parseEntity(id)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	switch entity.Prefix {
+	case "npub", "nprofile":
+		s.profile(w, r, id)
+	case "note", "nevent":
+		event, err := s.repository.FindEvent(r.Context(), entity)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if event.Kind == nostr.KindArticle {
+			s.article(w, r, id)
+			return
+		}
+		writeEvent(w, event)
+	default:
+		s.article(w, r, id)
+	}
+}
+
+type HistoryPage struct {
+
+	// Article as addressed in the request.
+	Id string
+
+	// Newest first.
+	Revisions []*Revision
+
+	// Versions compared, From is nil for an article never edited.
+	From *Revision
+	To   *Revision
+
+	// Word level diff of the markdown, as HTML.
+	Diff string
+}
+
+// List the cached versions of an article with the diff between two of
+// them, by default the two newest.
+func (s *Handler) History(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id := vars["nid"]
+
+	revisions, err := s.repository.History(r.Context(), id)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	// Version by hex id, or the one at index i if not given.
+	find := func(key string, i int) *Revision {
+		for _, rev := range revisions {
+			if key != "" && rev.Id == key {
+				return rev
+			}
+		}
+		if key == "" && i < len(revisions) {
+			return revisions[i]
+		}
+		return nil
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	page := &HistoryPage{
+		Id:        id,
+		Revisions: revisions,
+		From:      find(from, 1),
+		To:        find(to, 0),
+	}
+
+	// A version asked for by id must be one of this article's.
+	if (from != "" && page.From == nil) || (to != "" && page.To == nil) {
+		httpError(w, fmt.Errorf("%w: revision of %s", ErrNotFound, id))
+		return
+	}
+
+	if page.From != nil && page.To != nil {
+		page.Diff = diffHtml(diffWords(page.From.MdContent, page.To.MdContent))
+	}
+
+	tmpl, err := template.ParseFiles("static/history.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Rendered in full first, so a failure is not sent as a cut off page.
+	var buf bytes.Buffer
+
+	err = tmpl.Execute(&buf, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf.WriteTo(w)
+}
+
+// Serve the event as signed by its author, by hex id or a note or nevent
+// entity, see Repository.FindEvent.
+func (s *Handler) Event(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	entity, err := parseEntity(id)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if entity.Id == "" {
+		httpError(w, fmt.Errorf("%w: %s is not an event", ErrInvalidEntity, entity.Prefix))
+		return
+	}
+
+	event, err := s.repository.FindEvent(r.Context(), entity)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	writeEvent(w, event)
+}
+
+func writeEvent(w http.ResponseWriter, event *nostr.Event) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+type RelayStatus struct {
+	Url     string
+	Healthy bool
+	Info    *RelayInfo
+
+	// Events dropped for a bad id or signature.
+	Invalid int64
+}
+
+// Show every relay with its connection state and NIP-11 information.
+func (s *Handler) Relays(w http.ResponseWriter, r *http.Request) {
+
+	relays := []*RelayStatus{}
+
+	conns, release := s.repository.Relays()
+	defer release()
+
+	for _, ws := range conns {
+		relays = append(relays, &RelayStatus{
+			Url:     ws.Url(),
+			Healthy: ws.Healthy(),
+			Info:    ws.Info(),
+			Invalid: ws.Invalid(),
+		})
+	}
+
+	tmpl, err := template.ParseFiles("static/relays.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.Execute(w, relays)
+}
+
 func (s *Handler) Validate(w http.ResponseWriter, r *http.Request) {
 
 	pk := r.URL.Query().Get("search")
 
 	if pk != "" {
 
-		prefix, _, err := nostr.DecodeBech32(pk)
+		// Any NIP-19 entity ListEvents can resolve, or a hex event id.
+		_, err := parseEntity(pk)
 
 		if err != nil {
 			w.WriteHeader(http.StatusOK)
@@ -138,13 +508,6 @@ func (s *Handler) Validate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if prefix[0] != 'n' {
-			log.Println("start with npub")
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(`<span class="message error">Start with npub</span>`))
-			return
-		}
-
 		// Add text to show valid if you want to.
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`<span class="message success"> </span>`))
@@ -157,51 +520,124 @@ func (s *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
 
 	notes := []*Note{}
 
-	if strings.HasPrefix(search, nostr.UriEvent) {
+	// Relays that did not answer in time for any of the queries below.
+	timedOut := map[string]struct{}{}
+
+	// Hex pubkeys of the authors whose new articles are appended live.
+	authors := []string{}
+
+	// Add the articles of an author, pulled from the relays as well.
+	addAuthor := func(pk string, hints []string) error {
+
+		npub, err := nostr.EncodePublicKey(pk)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+		}
+
+		profile, articles, report, err := s.repository.FindArticles(r.Context(), npub, hints...)
+		if err != nil {
+			return err
+		}
+		authors = append(authors, pk)
+		log.Printf("articles for %s answered by relays: %v", pk, report.Answered)
+		for _, relay := range report.TimedOut {
+			timedOut[relay] = struct{}{}
+		}
+
+		for _, a := range articles {
+			n := &Note{
+				Article: a,
+				Profile: profile,
+			}
+			notes = append(notes, n)
+		}
+
+		return nil
+	}
+
+	// Add a single article with its author's profile.
+	addArticle := func(nid string, pk string, hints []string) error {
+
+		article, err := s.repository.Article(r.Context(), nid)
+		if err != nil {
+			return err
+		}
+
+		profile, err := s.repository.ProfileByPubkey(r.Context(), pk, hints...)
+		if err != nil {
+			return err
+		}
+
+		notes = append(notes, &Note{
+			Article: article,
+			Profile: profile,
+		})
+
+		return nil
+	}
+
+	// Add the article a note names, or the articles of every author in the
+	// NIP-51 list it names.
+	addEvent := func(entity *Entity) error {
+
+		event, err := s.repository.FindEvent(r.Context(), entity)
+		if err != nil {
+			return err
+		}
+
+		if event.Kind == nostr.KindArticle {
+			return addArticle(search, event.PubKey, entity.Relays)
+		}
 
 		// Pull the NIP-51 list event using event ID.
-		event, err := s.repository.CategorizedPeople(search)
+		list, err := s.repository.CategorizedPeople(r.Context(), entity)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		// Loop all authors (pubkeys) in NIP-51 event tags (list).
-		for _, value := range event.Tags {
-
-			t, v := value[0], value[1]
-
-			if t == "p" {
-				profile, articles, err := s.repository.FindArticles(v)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				for _, a := range articles {
-					n := &Note{
-						Article: a,
-						Profile: profile,
-					}
-					notes = append(notes, n)
-				}
+		for _, value := range list.Tags {
+
+			if len(value) < 2 || value[0] != "p" {
+				continue
+			}
+
+			// ["p", <pubkey>, <relay hint>]
+			hints := []string{}
+			if len(value) > 2 && value[2] != "" {
+				hints = append(hints, value[2])
+			}
+
+			err := addAuthor(value[1], hints)
+			if err != nil {
+				return err
 			}
 		}
-	} else if strings.HasPrefix(search, nostr.UriPub) {
 
-		log.Println("pull profile NIP-01")
+		return nil
+	}
+
+	if search != "" {
 
-		profile, articles, err := s.repository.FindArticles(search)
+		entity, err := parseEntity(search)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, err)
 			return
 		}
 
-		for _, a := range articles {
-			n := &Note{
-				Article: a,
-				Profile: profile,
-			}
-			notes = append(notes, n)
+		switch entity.Prefix {
+		case "npub", "nprofile":
+			log.Println("pull profile NIP-01")
+			err = addAuthor(entity.PubKey, entity.Relays)
+		case "naddr":
+			err = addArticle(search, entity.PubKey, entity.Relays)
+		case "note", "nevent":
+			err = addEvent(entity)
+		}
+
+		if err != nil {
+			httpError(w, err)
+			return
 		}
 	}
 
@@ -212,4 +648,19 @@ func (s *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tmpl.Execute(w, notes)
+
+	// Articles the authors publish while the page is open are appended here.
+	if len(authors) > 0 {
+		fmt.Fprintf(w, `<div class="live" hx-ext="sse" sse-connect="/live/events?authors=%s" sse-swap="article" hx-swap="beforeend"></div>`, url.QueryEscape(strings.Join(authors, ",")))
+	}
+
+	// Results are partial, tell the reader which relays were left out.
+	if len(timedOut) > 0 {
+		relays := []string{}
+		for relay := range timedOut {
+			relays = append(relays, html.EscapeString(relay))
+		}
+		sort.Strings(relays)
+		fmt.Fprintf(w, `<small class="message error">Timed out: %s</small>`, strings.Join(relays, ", "))
+	}
 }
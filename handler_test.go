@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dextryz/ixian/relaytest"
+	"github.com/dextryz/nostr"
+)
+
+// Public server over a repository backed by the relays.
+func testServer(t *testing.T, relays ...*relaytest.Relay) *httptest.Server {
+
+	t.Helper()
+
+	handler := Handler{
+		repository: *testRepository(t, relays...),
+	}
+
+	srv := httptest.NewServer(newRouter(handler))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// Status and body of a GET.
+func get(t *testing.T, srv *httptest.Server, path string) (int, string) {
+
+	t.Helper()
+
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestHandlerPages(t *testing.T) {
+
+	pk, _ := nostr.GetPublicKey(testSk)
+	npub, _ := nostr.EncodePublicKey(pk)
+	naddr, _ := EncodeAddress(pk, nostr.KindArticle, "golang")
+
+	article := signedEvent(t, 30023, "# Hello", 100,
+		nostr.Tag{"d", "golang"},
+		nostr.Tag{"title", "Hello Gophers"},
+		nostr.Tag{"t", "golang"},
+	)
+	note := signedEvent(t, 1, "just a note", 200)
+
+	r := testRelay(t,
+		signedEvent(t, 0, `{"name":"alice"}`, 50),
+		article,
+		note,
+	)
+	srv := testServer(t, r)
+
+	articleNote, _ := nostr.EncodeNote(article.Id)
+	noteId, _ := nostr.EncodeNote(note.Id)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/p/" + npub, http.StatusOK, "alice"},
+		{"/" + npub, http.StatusOK, "alice"},
+		{"/a/" + naddr, http.StatusOK, "Hello Gophers"},
+		{"/" + naddr, http.StatusOK, "Hello Gophers"},
+		{"/e/" + articleNote, http.StatusOK, "Hello Gophers"},
+		{"/" + article.Id, http.StatusOK, "Hello Gophers"},
+		{"/hashtag/golang", http.StatusOK, "alice"},
+		{"/e/" + noteId, http.StatusOK, "just a note"},
+		{"/a/garbage", http.StatusBadRequest, ""},
+		{"/p/" + noteId, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+
+		status, body := get(t, srv, tt.path)
+
+		if status != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, status, tt.status)
+			continue
+		}
+
+		if !strings.Contains(body, tt.body) {
+			t.Errorf("GET %s: body does not contain %q", tt.path, tt.body)
+		}
+	}
+}
+
+func TestHandlerEvent(t *testing.T) {
+
+	note := signedEvent(t, 1, "a <b>note</b>", 100)
+	srv := testServer(t, testRelay(t, note))
+
+	status, body := get(t, srv, "/event/"+note.Id)
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	var e nostr.Event
+
+	err := json.Unmarshal([]byte(body), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Id != note.Id || e.Sig != note.Sig || e.Content != note.Content {
+		t.Fatalf("got %+v, want the signed event as is", e)
+	}
+
+	missing, _ := nostr.EncodeNote(signedEvent(t, 1, "never published", 200).Id)
+
+	status, _ = get(t, srv, "/e/"+missing)
+	if status != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", status)
+	}
+}
+
+func TestHandlerHistory(t *testing.T) {
+
+	pk, _ := nostr.GetPublicKey(testSk)
+	naddr, _ := EncodeAddress(pk, nostr.KindArticle, "golang")
+
+	article := signedEvent(t, 30023, "# Hello", 100, nostr.Tag{"d", "golang"})
+	other := signedEvent(t, 1, "not a revision", 200)
+
+	srv := testServer(t, testRelay(t, article, other))
+
+	// Cached by viewing it.
+	status, _ := get(t, srv, "/a/"+naddr)
+	if status != http.StatusOK {
+		t.Fatalf("article status %d", status)
+	}
+
+	history := "/article/" + naddr + "/history"
+
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, "has not been edited"},
+		{"?to=" + article.Id, http.StatusOK, "has not been edited"},
+		{"?from=" + other.Id + "&to=" + article.Id, http.StatusNotFound, ""},
+		{"?from=" + article.Id + "&to=" + other.Id, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+
+		status, body := get(t, srv, history+tt.query)
+
+		if status != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.query, status, tt.status)
+			continue
+		}
+
+		if !strings.Contains(body, tt.body) {
+			t.Errorf("GET %s: body does not contain %q", tt.query, tt.body)
+		}
+	}
+}
+
+func TestHandlerSearch(t *testing.T) {
+
+	r := testRelay(t,
+		signedEvent(t, 0, `{"name":"alice"}`, 50),
+		signedEvent(t, 30023, "Goroutines and channels", 100, nostr.Tag{"d", "one"}, nostr.Tag{"title", "Concurrency"}, nostr.Tag{"t", "golang"}),
+	)
+
+	handler := Handler{
+		repository: *testRepository(t, r),
+	}
+
+	srv := httptest.NewServer(newRouter(handler))
+	defer srv.Close()
+
+	// Cache the article first, search is local.
+	status, _ := get(t, srv, "/hashtag/golang")
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	status, body := get(t, srv, "/search?q=channels")
+
+	if !handler.repository.db.fts {
+		if status != http.StatusNotImplemented {
+			t.Fatalf("status %d without FTS5, want 501", status)
+		}
+		return
+	}
+
+	if status != http.StatusOK || !strings.Contains(body, "Concurrency") {
+		t.Fatalf("status %d, body %s", status, body)
+	}
+}
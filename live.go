@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+// Keep a live subscription open on every healthy relay until ctx ends and
+// merge the events, deduplicated by id. Relays that drop and come back are
+// resubscribed by their connection.
+func (s *Repository) stream(ctx context.Context, relays []*Connection, f nostr.Filter) <-chan *nostr.Event {
+
+	out := make(chan *nostr.Event)
+
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+
+	var wg sync.WaitGroup
+
+	for _, ws := range usable(relays, f) {
+
+		sub, err := ws.SubscribeLive(nostr.Filters{clamp(ws, f)})
+		if err != nil {
+			log.Printf("relay %s: unable to subscribe: %v", ws.Url(), err)
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(ws *Connection, sub *Subscription) {
+			defer wg.Done()
+
+			// Sends CLOSE once the caller went away.
+			defer sub.Close()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e, ok := <-sub.EventStream:
+					if !ok {
+						log.Printf("relay %s: live subscription closed: %s", ws.Url(), sub.Reason())
+						return
+					}
+
+					mu.Lock()
+					_, dup := seen[e.Id]
+					seen[e.Id] = struct{}{}
+					mu.Unlock()
+
+					if dup {
+						continue
+					}
+
+					select {
+					case out <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(ws, sub)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// Articles matching f that are published from now on, cached as they
+// arrive and sent with their author's profile. The channel is closed once
+// ctx ends.
+func (s *Repository) LiveArticles(ctx context.Context, f nostr.Filter) <-chan *Note {
+
+	relays, release := s.Relays()
+
+	now := nostr.Timestamp(time.Now().Unix())
+
+	f.Kinds = []uint32{nostr.KindArticle}
+	f.Since = &now
+
+	events := s.stream(ctx, relays, f)
+
+	notes := make(chan *Note)
+
+	go func() {
+		defer close(notes)
+
+		// The relays are held for as long as the stream is open.
+		defer release()
+
+		for e := range events {
+
+			a, err := s.db.StoreArticle(ctx, e)
+			if err != nil {
+				log.Printf("live article %s: %v", e.Id, err)
+				continue
+			}
+
+			p, err := s.ProfileByPubkey(ctx, e.PubKey)
+			if err != nil {
+				log.Printf("live article %s: %v", e.Id, err)
+				continue
+			}
+
+			select {
+			case notes <- &Note{Article: a, Profile: p}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return notes
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,57 +22,73 @@ func StringEnv(key string) string {
 	return value
 }
 
-var (
-	CONFIG_NOSTR = StringEnv("CONFIG_NOSTR")
-)
+// Relay counters on /debug/vars, only reachable from this machine since
+// expvar also exposes the command line and memory stats.
+const debugAddr = "127.0.0.1:8082"
 
 func main() {
 
     log.Println("Starting...")
 
-	cfg, err := DecodeConfig(CONFIG_NOSTR)
+	cfg, err := DecodeConfig(StringEnv("CONFIG_NOSTR"))
 	if err != nil {
 		log.Fatalf("unable to decode local cfg: %v", err)
 	}
 
-	websockets := make([]*Connection, 0)
+	// Relays are dialed on first use, so one that is offline does not stop
+	// the server from starting.
+	pool := NewRelayPool(50, 5*time.Minute)
+
+	if cfg.PrivateKey != "" {
+		pool.EnableAuth(cfg.PrivateKey)
+	}
+
 	for _, v := range cfg.Relays {
-		cc := NewConnection(v)
-		err := cc.Listen()
+		err := pool.Configure(v, cfg.RelayOptions[v])
 		if err != nil {
-			log.Fatalf("unable to listen to relay: %v", err)
+			log.Printf("skipping relay: %v", err)
 		}
-		websockets = append(websockets, cc)
 	}
 
-	db := NewSqlite("nostr.db")
-	defer db.Close()
+	ttl, err := cfg.TTL()
+	if err != nil {
+		log.Fatalf("invalid cfg: %v", err)
+	}
 
 	repository := Repository{
-		db: db,
-		ws: websockets,
+		db:      NewSqlite("nostr.db"),
+		pool:    pool,
+		outbox:  newOutboxCache(),
+		timeout: DefaultQueryTimeout,
+
+		ttl:          ttl,
+		revalidating: newRevalidator(),
 	}
 
 	handler := Handler{
 		repository: repository,
 	}
 
-	r := mux.NewRouter()
-
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
-	r.PathPrefix("/fonts/").Handler(http.StripPrefix("/fonts/", http.FileServer(http.Dir("./fonts"))))
+	r := newRouter(handler)
 
-	r.HandleFunc("/", handler.Home).Methods("GET")
-	r.HandleFunc("/validate", handler.Validate).Methods("GET")
-	r.HandleFunc("/events", handler.ListEvents).Methods("GET")
-	r.HandleFunc("/hashtag/{ht:[a-zA-Z0-9]+}", handler.Tag).Methods("GET")
-	r.HandleFunc("/profile/{npub:[a-zA-Z0-9]+}", handler.Profile).Methods("GET")
-	r.HandleFunc("/article/{nid:[a-zA-Z0-9]+}", handler.Article).Methods("GET")
-	r.HandleFunc("/{id:[a-zA-Z0-9]+}", handler.Article).Methods("GET")
+	// Live streams never go idle on their own, so end them when shutting
+	// down instead of waiting for the shutdown timeout.
+	base, stopStreams := context.WithCancel(context.Background())
 
 	server := &http.Server{
-		Addr:    ":8081",
-		Handler: r,
+		Addr:        ":8081",
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+
+	server.RegisterOnShutdown(stopStreams)
+
+	debug := http.NewServeMux()
+	debug.Handle("/debug/vars", expvar.Handler())
+
+	debugServer := &http.Server{
+		Addr:    debugAddr,
+		Handler: debug,
 	}
 
 	// Create a channel to listen for OS signals
@@ -83,18 +101,55 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("debug listen: %s", err)
+		}
+	}()
+
 	<-stop
 
 	// Create a context with a timeout for the server's shutdown process
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// TODO: Close Repository
-	// - Closes all WS connections
-	// - Closes all subscriptions channels
-
 	if err = server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server Shutdown Failed:%+v", err)
 	}
+
+	debugServer.Close()
+
+	// Closes all relay connections and their subscriptions, then the cache.
+	if err = repository.Close(); err != nil {
+		log.Printf("close repository: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
+
+// Routes of the public server.
+func newRouter(handler Handler) *mux.Router {
+
+	r := mux.NewRouter()
+
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	r.PathPrefix("/fonts/").Handler(http.StripPrefix("/fonts/", http.FileServer(http.Dir("./fonts"))))
+
+	r.HandleFunc("/", handler.Home).Methods("GET")
+	r.HandleFunc("/validate", handler.Validate).Methods("GET")
+	r.HandleFunc("/events", handler.ListEvents).Methods("GET")
+	r.HandleFunc("/relays", handler.Relays).Methods("GET")
+	r.HandleFunc("/search", handler.Search).Methods("GET")
+	r.HandleFunc("/hashtag/{ht:[a-zA-Z0-9]+}", handler.Tag).Methods("GET")
+	r.HandleFunc("/live/events", handler.LiveEvents).Methods("GET")
+	r.HandleFunc("/live/hashtag/{ht:[a-zA-Z0-9]+}", handler.LiveTag).Methods("GET")
+	r.HandleFunc("/profile/{npub:[a-zA-Z0-9]+}", handler.Profile).Methods("GET")
+	r.HandleFunc("/article/{nid:[a-zA-Z0-9]+}", handler.Article).Methods("GET")
+	r.HandleFunc("/article/{nid:[a-zA-Z0-9]+}/history", handler.History).Methods("GET")
+	r.HandleFunc("/event/{id:[a-zA-Z0-9]+}", handler.Event).Methods("GET")
+	r.HandleFunc("/a/{nid:[a-zA-Z0-9]+}", handler.Article).Methods("GET")
+	r.HandleFunc("/e/{id:[a-zA-Z0-9]+}", handler.Entity).Methods("GET")
+	r.HandleFunc("/p/{npub:[a-zA-Z0-9]+}", handler.Profile).Methods("GET")
+	r.HandleFunc("/{id:[a-zA-Z0-9]+}", handler.Entity).Methods("GET")
+
+	return r
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dextryz/ixian/relaytest"
+	"github.com/dextryz/nostr"
+)
+
+// Secret key the test events are signed with.
+const testSk = "0000000000000000000000000000000000000000000000000000000000000001"
+
+// Signed event by testSk.
+func signedEvent(t *testing.T, kind uint32, content string, createdAt int64, tags ...nostr.Tag) nostr.Event {
+
+	t.Helper()
+
+	e := nostr.Event{
+		Kind:      kind,
+		Content:   content,
+		CreatedAt: nostr.Timestamp(createdAt),
+		Tags:      tags,
+	}
+
+	err := e.Sign(testSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// Relay seeded with the events, closed when the test ends.
+func testRelay(t *testing.T, events ...nostr.Event) *relaytest.Relay {
+
+	t.Helper()
+
+	r := relaytest.NewRelay(events...)
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+// Connection listening to the relay, closed when the test ends.
+func testConnection(t *testing.T, r *relaytest.Relay) *Connection {
+
+	t.Helper()
+
+	c := NewConnection(r.URL)
+
+	err := c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// Repository over a fresh database and the relays, closed when the test
+// ends. Nothing is refreshed in the background.
+func testRepository(t *testing.T, relays ...*relaytest.Relay) *Repository {
+
+	t.Helper()
+
+	pool := NewRelayPool(10, time.Minute)
+
+	for _, r := range relays {
+		err := pool.Configure(r.URL, RelayOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Repository{
+		db:      NewSqlite(filepath.Join(t.TempDir(), "nostr.db")),
+		pool:    pool,
+		outbox:  newOutboxCache(),
+		timeout: 2 * time.Second,
+		ttl:     time.Hour,
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// Events of a stored query until EOSE. Generous deadline, the reader
+// verifies every signature and is slow under -race.
+func drain(t *testing.T, sub *Subscription) []*nostr.Event {
+
+	t.Helper()
+
+	events := []*nostr.Event{}
+
+	for {
+		select {
+		case e := <-sub.EventStream:
+			events = append(events, e)
+		case <-sub.Done:
+			return events
+		case <-sub.Closed():
+			t.Fatalf("subscription %s closed: %s", sub.GetId(), sub.Reason())
+		case <-time.After(30 * time.Second):
+			t.Fatalf("subscription %s: no EOSE", sub.GetId())
+		}
+	}
+}
+
+// Wait for cond, failing the test after a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
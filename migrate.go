@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+// Versioned change to the schema of the cache. Migrations are applied in
+// order, each in its own transaction, and never edited once released: a
+// schema change is a new migration at the end of the list.
+type migration struct {
+	version int
+	name    string
+
+	// Drops or rewrites cached data, the database is backed up first.
+	destructive bool
+
+	up func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Databases created before migrations were tracked have no schema_version
+// and run every migration, so each one also has to apply cleanly to the
+// schema of any earlier release.
+var migrations = []migration{
+	{1, "baseline tables", false, migrateBaseline},
+	{2, "raw event table", true, migrateEvents},
+	{3, "profile update tracking", false, migrateProfileUpdates},
+	{4, "articles keyed by address", true, migrateArticleAddress},
+	{5, "article search index", false, migrateArticleSearch},
+	{6, "event tag index", false, migrateEventTags},
+	{7, "entity freshness", true, migrateFreshness},
+}
+
+// Bring the database up to the latest schema. Before the first destructive
+// migration on a database that already holds a cache, a copy is written
+// next to it, see backup.
+func migrate(ctx context.Context, db *sql.DB, path string) error {
+
+	_, err := db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at INTEGER NOT NULL
+    );`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, `SELECT IFNULL(MAX(version), 0) FROM schema_version`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to back up in a database created just now.
+	var tables int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'`).Scan(&tables)
+	if err != nil {
+		return err
+	}
+
+	backedUp := tables == 0
+
+	for _, m := range migrations {
+
+		if m.version <= current {
+			continue
+		}
+
+		if m.destructive && !backedUp {
+			err := backup(ctx, db, path, current)
+			if err != nil {
+				return fmt.Errorf("migration %d: %w", m.version, err)
+			}
+			backedUp = true
+		}
+
+		err := apply(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+
+		log.Printf("schema migrated to version %d: %s", m.version, m.name)
+	}
+
+	return nil
+}
+
+// Run the migration and record it in one transaction, so a failure leaves
+// the schema at the previous version.
+func apply(ctx context.Context, db *sql.DB, m migration) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.up(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Copy the database to <path>.v<version>.bak, replacing an older backup of
+// the same version. In-memory databases have nothing to keep.
+func backup(ctx context.Context, db *sql.DB, path string, version int) error {
+
+	if path == "" || path == ":memory:" {
+		return nil
+	}
+
+	dest := fmt.Sprintf("%s.v%d.bak", path, version)
+
+	// VACUUM INTO refuses to overwrite a file.
+	err := os.Remove(dest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "VACUUM INTO ?", dest)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("database backed up to %s", dest)
+
+	return nil
+}
+
+func migrateBaseline(ctx context.Context, tx *sql.Tx) error {
+
+	createArticleSQL := `
+    CREATE TABLE IF NOT EXISTS article (
+        article_id TEXT PRIMARY KEY,
+        image TEXT,
+        title TEXT,
+        summary TEXT,
+        md_content TEXT,
+        html_content TEXT,
+        published_at INTEGER
+    );`
+
+	createTagSQL := `
+    CREATE TABLE IF NOT EXISTS hashtag (
+        hashtag_name TEXT PRIMARY KEY
+    );`
+
+	createArticleHashtagSQL := `
+    CREATE TABLE IF NOT EXISTS article_hashtag (
+        article_id TEXT,
+        hashtag_name TEXT,
+        FOREIGN KEY (article_id) REFERENCES article (article_id),
+        FOREIGN KEY (hashtag_name) REFERENCES hashtag (hashtag_name),
+        PRIMARY KEY (article_id, hashtag_name)
+    );`
+
+	createProfileSQL := `
+    CREATE TABLE IF NOT EXISTS profile (
+        pubkey TEXT PRIMARY KEY,
+        name TEXT,
+        about TEXT,
+        website TEXT,
+        banner TEXT,
+        picture TEXT,
+        identifier TEXT
+    );`
+
+	createArticleProfileSQL := `
+    CREATE TABLE IF NOT EXISTS article_profile (
+        article_id TEXT,
+        pubkey TEXT,
+        FOREIGN KEY (article_id) REFERENCES article (article_id),
+        FOREIGN KEY (pubkey) REFERENCES profile (pubkey),
+        PRIMARY KEY (article_id, pubkey)
+    )
+    `
+
+	for _, stmt := range []string{createProfileSQL, createArticleProfileSQL, createArticleSQL, createTagSQL, createArticleHashtagSQL} {
+		_, err := tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Signed events as received, the article and profile tables are projections
+// of these rows. Replaces the article_event table of earlier releases, the
+// events it listed are synced again. Events stored before d tags were kept
+// get them from the raw event.
+func migrateEvents(ctx context.Context, tx *sql.Tx) error {
+
+	createEventSQL := `
+    CREATE TABLE IF NOT EXISTS event (
+        id TEXT PRIMARY KEY,
+        pubkey TEXT NOT NULL,
+        kind INTEGER NOT NULL,
+        created_at INTEGER NOT NULL,
+        d_tag TEXT,
+        raw TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS event_author ON event (pubkey, kind, created_at);
+    CREATE INDEX IF NOT EXISTS event_kind ON event (kind, created_at);
+    CREATE INDEX IF NOT EXISTS event_address ON event (pubkey, kind, d_tag);
+    DROP TABLE IF EXISTS article_event;
+    `
+
+	_, err := tx.ExecContext(ctx, createEventSQL)
+	if err != nil {
+		return err
+	}
+
+	events, err := scanEvents(ctx, tx, `SELECT raw FROM event WHERE kind >= 30000 AND kind < 40000 AND d_tag IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		_, err := tx.ExecContext(ctx, "UPDATE event SET d_tag = ? WHERE id = ?", identifier(e), e.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateProfileUpdates(ctx context.Context, tx *sql.Tx) error {
+
+	err := addColumn(ctx, tx, "profile", "created_at", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	return addColumn(ctx, tx, "profile", "refreshed_at", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// Articles used to be keyed by note1 event id, one row per version. Drop
+// those rows and project the newest version of every address from the
+// stored events instead. Caches older than the event table have no events
+// to project, their articles are synced again.
+func migrateArticleAddress(ctx context.Context, tx *sql.Tx) error {
+
+	for _, table := range []string{"article_hashtag", "article_profile", "article"} {
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE article_id LIKE 'note1%'")
+		if err != nil {
+			return err
+		}
+	}
+
+	events, err := scanEvents(ctx, tx, `SELECT raw FROM event WHERE kind = ? ORDER BY created_at DESC, id ASC`, nostr.KindArticle)
+	if err != nil {
+		return err
+	}
+
+	// Newest first, so the first version seen of an address is current.
+	seen := make(map[string]struct{})
+
+	for _, e := range events {
+
+		address := e.PubKey + ":" + identifier(e)
+		if _, ok := seen[address]; ok {
+			continue
+		}
+		seen[address] = struct{}{}
+
+		_, err := projectArticle(ctx, tx, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FTS5 index over the cached articles and their author's name, see
+// SearchArticles. SQLite built without FTS5 skips it, NewSqlite creates
+// it once a build with -tags sqlite_fts5 opens the database.
+func migrateArticleSearch(ctx context.Context, tx *sql.Tx) error {
+
+	err := createSearchIndex(ctx, tx)
+	if errors.Is(err, ErrNoFTS5) {
+		log.Printf("skipping article search index: %v", err)
+		return nil
+	}
+
+	return err
+}
+
+// Single letter tags of the cached events, matched by #<letter> filters in
+// QueryEvents.
+func migrateEventTags(ctx context.Context, tx *sql.Tx) error {
+
+	_, err := tx.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS event_tag (
+        event_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        value TEXT NOT NULL,
+        FOREIGN KEY (event_id) REFERENCES event (id),
+        PRIMARY KEY (event_id, name, value)
+    );
+    CREATE INDEX IF NOT EXISTS event_tag_value ON event_tag (name, value);
+    `)
+	if err != nil {
+		return err
+	}
+
+	events, err := scanEvents(ctx, tx, `SELECT raw FROM event`)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		err := insertTags(ctx, tx, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// When each cached entity was last refreshed from the relays, see
+// cacheFirst. Takes over the refreshed_at column of the profile table.
+func migrateFreshness(ctx context.Context, tx *sql.Tx) error {
+
+	_, err := tx.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS freshness (
+        entity TEXT PRIMARY KEY,
+        refreshed_at INTEGER NOT NULL
+    );
+    INSERT OR REPLACE INTO freshness (entity, refreshed_at)
+    SELECT 'profile:' || pubkey, refreshed_at FROM profile WHERE refreshed_at > 0;
+    ALTER TABLE profile DROP COLUMN refreshed_at;
+    `)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Add the column to the table unless it already has it.
+func addColumn(ctx context.Context, q querier, table, column, decl string) error {
+
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+decl)
+
+	return err
+}
+
+// Decode the raw events selected by the query.
+func scanEvents(ctx context.Context, q querier, query string, args ...any) ([]*nostr.Event, error) {
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*nostr.Event{}
+	for rows.Next() {
+		var raw string
+		err := rows.Scan(&raw)
+		if err != nil {
+			return nil, err
+		}
+		var e nostr.Event
+		err = json.Unmarshal([]byte(raw), &e)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Schema of the first release, before migrations were tracked.
+const baselineSchema = `
+CREATE TABLE profile (
+    pubkey TEXT PRIMARY KEY,
+    name TEXT,
+    about TEXT,
+    website TEXT,
+    banner TEXT,
+    picture TEXT,
+    identifier TEXT
+);
+CREATE TABLE article_profile (
+    article_id TEXT,
+    pubkey TEXT,
+    FOREIGN KEY (article_id) REFERENCES article (article_id),
+    FOREIGN KEY (pubkey) REFERENCES profile (pubkey),
+    PRIMARY KEY (article_id, pubkey)
+);
+CREATE TABLE article (
+    article_id TEXT PRIMARY KEY,
+    image TEXT,
+    title TEXT,
+    summary TEXT,
+    md_content TEXT,
+    html_content TEXT,
+    published_at INTEGER
+);
+CREATE TABLE hashtag (
+    hashtag_name TEXT PRIMARY KEY
+);
+CREATE TABLE article_hashtag (
+    article_id TEXT,
+    hashtag_name TEXT,
+    FOREIGN KEY (article_id) REFERENCES article (article_id),
+    FOREIGN KEY (hashtag_name) REFERENCES hashtag (hashtag_name),
+    PRIMARY KEY (article_id, hashtag_name)
+);
+INSERT INTO profile VALUES ('npub1alice', 'alice', 'about', 'https://alice.example', '', '', 'alice@example.com');
+INSERT INTO article VALUES ('note1legacy', '', 'Legacy', '', '# Legacy', '<h1>Legacy</h1>', 1700000000);
+INSERT INTO article_profile VALUES ('note1legacy', 'npub1alice');
+INSERT INTO hashtag VALUES ('nostr');
+INSERT INTO article_hashtag VALUES ('note1legacy', 'nostr');
+`
+
+func TestMigrateBaseline(t *testing.T) {
+
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "nostr.db")
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = raw.ExecContext(ctx, baselineSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrate(ctx, raw, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version, applied int
+
+	err = raw.QueryRowContext(ctx, `SELECT MAX(version), COUNT(*) FROM schema_version`).Scan(&version, &applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 7 || applied != 7 {
+		t.Fatalf("schema at version %d with %d migrations applied, want 7", version, applied)
+	}
+
+	// The cache as it was before the first destructive migration.
+	backup := path + ".v0.bak"
+
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(t, backup, `SELECT COUNT(*) FROM article`); n != 1 {
+		t.Fatalf("backup holds %d articles, want 1", n)
+	}
+
+	want := map[string]string{
+		"event":           "[id pubkey kind created_at d_tag raw]",
+		"event_tag":       "[event_id name value]",
+		"article":         "[article_id image title summary md_content html_content published_at]",
+		"article_profile": "[article_id pubkey]",
+		"article_hashtag": "[article_id hashtag_name]",
+		"hashtag":         "[hashtag_name]",
+		"profile":         "[pubkey name about website banner picture identifier created_at]",
+		"freshness":       "[entity refreshed_at]",
+		"schema_version":  "[version name applied_at]",
+	}
+
+	for table, cols := range want {
+		if got := columns(t, raw, table); got != cols {
+			t.Errorf("table %s: columns %s, want %s", table, got, cols)
+		}
+	}
+
+	for _, index := range []string{"event_author", "event_kind", "event_address", "event_tag_value"} {
+		var n int
+		raw.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?`, index).Scan(&n)
+		if n != 1 {
+			t.Errorf("index %s missing", index)
+		}
+	}
+
+	// Only SQLite built with FTS5 gets the search index.
+	var search int
+	raw.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'article_search'`).Scan(&search)
+	if (search == 1) != hasFTS5(ctx, raw) {
+		t.Errorf("article_search created: %v, FTS5: %v", search == 1, hasFTS5(ctx, raw))
+	}
+
+	// Profiles are kept, articles keyed by note id are pulled again.
+	var name string
+	raw.QueryRowContext(ctx, `SELECT name FROM profile WHERE pubkey = 'npub1alice'`).Scan(&name)
+	if name != "alice" {
+		t.Errorf("profile not kept")
+	}
+
+	for _, table := range []string{"article", "article_profile", "article_hashtag"} {
+		var n int
+		raw.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table).Scan(&n)
+		if n != 0 {
+			t.Errorf("%d legacy rows left in %s", n, table)
+		}
+	}
+
+	raw.Close()
+
+	// Reopening applies nothing and backs nothing up.
+	db := NewSqlite(path)
+	defer db.Close()
+
+	db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_version`).Scan(&applied)
+	if applied != 7 {
+		t.Fatalf("%d migrations recorded after reopening, want 7", applied)
+	}
+
+	if _, err := os.Stat(path + ".v7.bak"); err == nil {
+		t.Fatal("migrated database backed up again")
+	}
+}
+
+func TestMigrateFresh(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "nostr.db")
+
+	db := NewSqlite(path)
+	defer db.Close()
+
+	var version int
+	db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if version != len(migrations) {
+		t.Fatalf("schema at version %d, want %d", version, len(migrations))
+	}
+
+	// Nothing to keep in a database created just now.
+	if _, err := os.Stat(path + ".v0.bak"); err == nil {
+		t.Fatal("fresh database backed up")
+	}
+}
+
+// Column names of the table, in order.
+func columns(t *testing.T, db *sql.DB, table string) string {
+
+	t.Helper()
+
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+
+	return fmt.Sprint(names)
+}
+
+// Result of a COUNT query on the database at path.
+func count(t *testing.T, path, query string) int {
+
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n int
+
+	err = db.QueryRow(query).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
@@ -0,0 +1,482 @@
+// Package negentropy implements the range-based set reconciliation protocol
+// (version 1) used by NIP-77. Two parties holding sets of events sorted by
+// (created_at, id) exchange fingerprints of ranges, splitting the ranges
+// that differ until each side knows which ids the other one is missing.
+package negentropy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	protocolVersion = 0x61
+
+	idSize          = 32
+	fingerprintSize = 16
+
+	// Ranges with fewer items than twice this are sent as id lists.
+	buckets = 16
+)
+
+const (
+	modeSkip        = 0
+	modeFingerprint = 1
+	modeIdList      = 2
+)
+
+// Timestamp of the bound past the last item.
+const infinity = math.MaxUint64
+
+var ErrUnsupportedVersion = errors.New("negentropy: unsupported protocol version")
+var ErrMalformed = errors.New("negentropy: malformed message")
+
+// Event as far as reconciliation is concerned.
+type Item struct {
+	Timestamp uint64
+	Id        [idSize]byte
+}
+
+// Item from a created_at and a hex event id.
+func NewItem(timestamp int64, id string) (Item, error) {
+
+	raw, err := hex.DecodeString(id)
+	if err != nil {
+		return Item{}, err
+	}
+
+	if len(raw) != idSize {
+		return Item{}, fmt.Errorf("negentropy: id %q is not %d bytes", id, idSize)
+	}
+
+	item := Item{Timestamp: uint64(timestamp)}
+	copy(item.Id[:], raw)
+
+	return item, nil
+}
+
+func (a Item) less(b Item) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return bytes.Compare(a.Id[:], b.Id[:]) < 0
+}
+
+// Boundary between ranges. The id may be a prefix, just long enough to
+// tell two items with the same timestamp apart.
+type bound struct {
+	timestamp uint64
+	id        []byte
+}
+
+// Whether the item sorts before the bound.
+func (b bound) after(item Item) bool {
+	if item.Timestamp != b.timestamp {
+		return item.Timestamp < b.timestamp
+	}
+	return bytes.Compare(item.Id[:], b.id) < 0
+}
+
+// One side of a reconciliation. Create it with the local items, then
+// either Initiate and feed the replies to Reconcile as the client, or only
+// call Reconcile as the relay.
+type Negentropy struct {
+	items []Item
+
+	initiator bool
+
+	// Timestamps are delta encoded within a message.
+	lastIn  uint64
+	lastOut uint64
+}
+
+func New(items []Item) *Negentropy {
+
+	sorted := append([]Item{}, items...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].less(sorted[j])
+	})
+
+	return &Negentropy{items: sorted}
+}
+
+// First message of the client, covering the whole set.
+func (s *Negentropy) Initiate() []byte {
+
+	s.initiator = true
+	s.lastOut = 0
+
+	out := []byte{protocolVersion}
+	out = s.splitRange(out, 0, len(s.items), bound{timestamp: infinity})
+
+	return out
+}
+
+// Process a message from the other side. Returns the next message to send,
+// which is nil once a client is done, and as a client the ids only we
+// have and the ids only the other side has, in hex.
+func (s *Negentropy) Reconcile(msg []byte) ([]byte, []string, []string, error) {
+
+	have := []string{}
+	need := []string{}
+
+	s.lastIn = 0
+	s.lastOut = 0
+
+	r := &reader{buf: msg}
+
+	version, err := r.byte()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	out := []byte{protocolVersion}
+
+	if version < 0x60 || version > 0x6f {
+		return nil, nil, nil, ErrMalformed
+	}
+
+	if version != protocolVersion {
+		if s.initiator {
+			return nil, nil, nil, ErrUnsupportedVersion
+		}
+		// Tell the client which version we speak.
+		return out, have, need, nil
+	}
+
+	prev := bound{}
+	prevIndex := 0
+	skip := false
+
+	for r.len() > 0 {
+
+		o := []byte{}
+
+		// Ranges that matched are only written out when a range after them
+		// needs a reply, as one skip up to the previous bound.
+		flushSkip := func() {
+			if skip {
+				skip = false
+				o = s.encodeBound(o, prev)
+				o = appendVarint(o, modeSkip)
+			}
+		}
+
+		curr, err := s.decodeBound(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		mode, err := r.varint()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		lower := prevIndex
+		upper := s.lowerBound(prevIndex, curr)
+
+		switch mode {
+		case modeSkip:
+			skip = true
+
+		case modeFingerprint:
+			theirs, err := r.bytes(fingerprintSize)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			ours := s.fingerprint(lower, upper)
+
+			if bytes.Equal(theirs, ours[:]) {
+				skip = true
+			} else {
+				flushSkip()
+				o = s.splitRange(o, lower, upper, curr)
+			}
+
+		case modeIdList:
+			n, err := r.varint()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			theirs := make(map[[idSize]byte]struct{}, n)
+			for i := uint64(0); i < n; i++ {
+				id, err := r.bytes(idSize)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				theirs[[idSize]byte(id)] = struct{}{}
+			}
+
+			if s.initiator {
+
+				// The relay listed its ids in full, nothing left to split.
+				skip = true
+
+				for _, item := range s.items[lower:upper] {
+					if _, ok := theirs[item.Id]; ok {
+						delete(theirs, item.Id)
+					} else {
+						have = append(have, hex.EncodeToString(item.Id[:]))
+					}
+				}
+
+				for id := range theirs {
+					need = append(need, hex.EncodeToString(id[:]))
+				}
+
+			} else {
+
+				// Answer with our ids in the range so the client can diff.
+				flushSkip()
+
+				o = s.encodeBound(o, curr)
+				o = appendVarint(o, modeIdList)
+				o = appendVarint(o, uint64(upper-lower))
+				for _, item := range s.items[lower:upper] {
+					o = append(o, item.Id[:]...)
+				}
+			}
+
+		default:
+			return nil, nil, nil, fmt.Errorf("%w: unknown mode %d", ErrMalformed, mode)
+		}
+
+		out = append(out, o...)
+
+		prevIndex = upper
+		prev = curr
+	}
+
+	// Only the version byte, the client has nothing left to ask.
+	if s.initiator && len(out) == 1 {
+		return nil, have, need, nil
+	}
+
+	return out, have, need, nil
+}
+
+// Fingerprint the range if it is large, otherwise list its ids.
+func (s *Negentropy) splitRange(o []byte, lower, upper int, upperBound bound) []byte {
+
+	n := upper - lower
+
+	if n < buckets*2 {
+		o = s.encodeBound(o, upperBound)
+		o = appendVarint(o, modeIdList)
+		o = appendVarint(o, uint64(n))
+		for _, item := range s.items[lower:upper] {
+			o = append(o, item.Id[:]...)
+		}
+		return o
+	}
+
+	perBucket := n / buckets
+	withExtra := n % buckets
+
+	curr := lower
+
+	for i := 0; i < buckets; i++ {
+
+		size := perBucket
+		if i < withExtra {
+			size++
+		}
+
+		fp := s.fingerprint(curr, curr+size)
+		curr += size
+
+		next := upperBound
+		if curr != upper {
+			next = minimalBound(s.items[curr-1], s.items[curr])
+		}
+
+		o = s.encodeBound(o, next)
+		o = appendVarint(o, modeFingerprint)
+		o = append(o, fp[:]...)
+	}
+
+	return o
+}
+
+// Shortest bound that sorts after prev and not after curr.
+func minimalBound(prev, curr Item) bound {
+
+	if curr.Timestamp != prev.Timestamp {
+		return bound{timestamp: curr.Timestamp}
+	}
+
+	shared := 0
+	for shared < idSize && curr.Id[shared] == prev.Id[shared] {
+		shared++
+	}
+
+	return bound{timestamp: curr.Timestamp, id: curr.Id[:shared+1]}
+}
+
+// Index of the first item from begin that does not sort before the bound.
+func (s *Negentropy) lowerBound(begin int, b bound) int {
+	return begin + sort.Search(len(s.items)-begin, func(i int) bool {
+		return !b.after(s.items[begin+i])
+	})
+}
+
+// Sum of the ids as 256-bit little-endian integers, followed by the count,
+// hashed and truncated.
+func (s *Negentropy) fingerprint(lower, upper int) [fingerprintSize]byte {
+
+	var sum [idSize]byte
+
+	for _, item := range s.items[lower:upper] {
+		var carry uint16
+		for i := 0; i < idSize; i++ {
+			v := uint16(sum[i]) + uint16(item.Id[i]) + carry
+			sum[i] = byte(v)
+			carry = v >> 8
+		}
+	}
+
+	input := appendVarint(sum[:], uint64(upper-lower))
+	hash := sha256.Sum256(input)
+
+	var fp [fingerprintSize]byte
+	copy(fp[:], hash[:fingerprintSize])
+
+	return fp
+}
+
+func (s *Negentropy) encodeBound(o []byte, b bound) []byte {
+	o = s.encodeTimestamp(o, b.timestamp)
+	o = appendVarint(o, uint64(len(b.id)))
+	return append(o, b.id...)
+}
+
+func (s *Negentropy) decodeBound(r *reader) (bound, error) {
+
+	timestamp, err := s.decodeTimestamp(r)
+	if err != nil {
+		return bound{}, err
+	}
+
+	n, err := r.varint()
+	if err != nil {
+		return bound{}, err
+	}
+
+	if n > idSize {
+		return bound{}, fmt.Errorf("%w: bound id of %d bytes", ErrMalformed, n)
+	}
+
+	id, err := r.bytes(int(n))
+	if err != nil {
+		return bound{}, err
+	}
+
+	return bound{timestamp: timestamp, id: id}, nil
+}
+
+// Zero is infinity, anything else one more than the delta to the previous
+// timestamp in the message.
+func (s *Negentropy) encodeTimestamp(o []byte, timestamp uint64) []byte {
+
+	if timestamp == infinity {
+		s.lastOut = infinity
+		return appendVarint(o, 0)
+	}
+
+	delta := timestamp - s.lastOut
+	s.lastOut = timestamp
+
+	return appendVarint(o, delta+1)
+}
+
+func (s *Negentropy) decodeTimestamp(r *reader) (uint64, error) {
+
+	v, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+
+	if v == 0 || s.lastIn == infinity {
+		s.lastIn = infinity
+		return infinity, nil
+	}
+
+	s.lastIn += v - 1
+
+	return s.lastIn, nil
+}
+
+// Base-128, most significant group first, high bit set on all but the last.
+func appendVarint(o []byte, n uint64) []byte {
+
+	if n == 0 {
+		return append(o, 0)
+	}
+
+	groups := []byte{}
+	for n > 0 {
+		groups = append(groups, byte(n&0x7f))
+		n >>= 7
+	}
+
+	for i := len(groups) - 1; i >= 0; i-- {
+		b := groups[i]
+		if i > 0 {
+			b |= 0x80
+		}
+		o = append(o, b)
+	}
+
+	return o
+}
+
+type reader struct {
+	buf []byte
+}
+
+func (r *reader) len() int {
+	return len(r.buf)
+}
+
+func (r *reader) byte() (byte, error) {
+	if len(r.buf) == 0 {
+		return 0, ErrMalformed
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if len(r.buf) < n {
+		return nil, ErrMalformed
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func (r *reader) varint() (uint64, error) {
+
+	var n uint64
+
+	for i := 0; i < 10; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: varint too long", ErrMalformed)
+}
@@ -0,0 +1,396 @@
+package negentropy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// The vectors below follow the protocol description of the reference
+// implementation (hoytech/negentropy, docs/protocol.md). The fingerprints
+// were computed from that definition outside of this package.
+
+func TestVarint(t *testing.T) {
+
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{127, "7f"},
+		{128, "8100"},
+		{255, "817f"},
+		{16383, "ff7f"},
+		{16384, "818000"},
+		{1 << 32, "9080808000"},
+		{infinity, "81ffffffffffffffff7f"},
+	}
+
+	for _, tt := range tests {
+
+		got := hex.EncodeToString(appendVarint(nil, tt.n))
+		if got != tt.want {
+			t.Errorf("encode %d: got %s, want %s", tt.n, got, tt.want)
+		}
+
+		raw, _ := hex.DecodeString(tt.want)
+		r := &reader{buf: raw}
+
+		n, err := r.varint()
+		if err != nil || n != tt.n || r.len() != 0 {
+			t.Errorf("decode %s: got %d, %v", tt.want, n, err)
+		}
+	}
+
+	r := &reader{buf: []byte{0x81, 0x80}}
+
+	_, err := r.varint()
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("truncated varint: got %v, want ErrMalformed", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+
+	tests := []struct {
+		name string
+		ids  []string
+		want string
+	}{
+		{
+			name: "empty",
+			want: "7f9c9e31ac8256ca2f258583df262dbc",
+		},
+		{
+			name: "little-endian sum",
+			ids: []string{
+				"0000000000000000000000000000000000000000000000000000000000000001",
+				"0200000000000000000000000000000000000000000000000000000000000000",
+			},
+			want: "62c6b7d3d0261f3c5ef6b2f0fd8513a7",
+		},
+		{
+			name: "sum wraps at 256 bits",
+			ids: []string{
+				"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+				"0100000000000000000000000000000000000000000000000000000000000000",
+			},
+			want: "58cc2f44d3a27866874701fbad573da9",
+		},
+		{
+			name: "three",
+			ids: []string{
+				"0101010101010101010101010101010101010101010101010101010101010101",
+				"0202020202020202020202020202020202020202020202020202020202020202",
+				"0303030303030303030303030303030303030303030303030303030303030303",
+			},
+			want: "c07a25db62a65dc5477decb10bf5f293",
+		},
+	}
+
+	for _, tt := range tests {
+
+		items := []Item{}
+		for i, id := range tt.ids {
+			items = append(items, mustItem(t, int64(i), id))
+		}
+
+		s := New(items)
+
+		fp := s.fingerprint(0, len(items))
+		if got := hex.EncodeToString(fp[:]); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampDeltas(t *testing.T) {
+
+	s := &Negentropy{}
+
+	o := s.encodeBound(nil, bound{timestamp: 10})
+	o = s.encodeBound(o, bound{timestamp: 15, id: []byte{0xab}})
+	o = s.encodeBound(o, bound{timestamp: 15})
+	o = s.encodeBound(o, bound{timestamp: infinity})
+
+	// 10+1, then 5+1 with a one byte id, then 0+1, then infinity as 0.
+	want := "0b00" + "0601ab" + "0100" + "0000"
+
+	if got := hex.EncodeToString(o); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	r := &reader{buf: o}
+
+	for _, b := range []bound{{timestamp: 10}, {timestamp: 15, id: []byte{0xab}}, {timestamp: 15}, {timestamp: infinity}} {
+
+		got, err := s.decodeBound(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.timestamp != b.timestamp || !bytes.Equal(got.id, b.id) {
+			t.Fatalf("got %+v, want %+v", got, b)
+		}
+	}
+
+	// Once infinity, a message stays there.
+	r = &reader{buf: []byte{0x05, 0x00}}
+
+	ts, err := s.decodeTimestamp(r)
+	if err != nil || ts != infinity {
+		t.Fatalf("got %d, %v, want infinity", ts, err)
+	}
+}
+
+func TestMinimalBound(t *testing.T) {
+
+	prev := mustItem(t, 100, "aabbcc0000000000000000000000000000000000000000000000000000000000")
+
+	tests := []struct {
+		name string
+		curr Item
+		want bound
+	}{
+		{
+			name: "later timestamp needs no id",
+			curr: mustItem(t, 101, "0000000000000000000000000000000000000000000000000000000000000000"),
+			want: bound{timestamp: 101},
+		},
+		{
+			name: "same timestamp, prefix up to the first differing byte",
+			curr: mustItem(t, 100, "aabbdd0000000000000000000000000000000000000000000000000000000000"),
+			want: bound{timestamp: 100, id: []byte{0xaa, 0xbb, 0xdd}},
+		},
+		{
+			name: "same timestamp, differing first byte",
+			curr: mustItem(t, 100, "ff00000000000000000000000000000000000000000000000000000000000000"),
+			want: bound{timestamp: 100, id: []byte{0xff}},
+		},
+	}
+
+	for _, tt := range tests {
+
+		got := minimalBound(prev, tt.curr)
+
+		if got.timestamp != tt.want.timestamp || !bytes.Equal(got.id, tt.want.id) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+
+		if !got.after(prev) || got.after(tt.curr) {
+			t.Errorf("%s: bound does not separate the items", tt.name)
+		}
+	}
+}
+
+func TestInitiate(t *testing.T) {
+
+	id := "aa00000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		name  string
+		items []Item
+		want  string
+	}{
+		{
+			// Version, infinity bound without id, id list of zero ids.
+			name: "empty",
+			want: "6100000200",
+		},
+		{
+			name:  "one item",
+			items: []Item{mustItem(t, 10, id)},
+			want:  "6100000201" + id,
+		},
+	}
+
+	for _, tt := range tests {
+
+		got := hex.EncodeToString(New(tt.items).Initiate())
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Large sets are split into fingerprinted buckets.
+	msg := New(randomItems(100, 1)).Initiate()
+
+	want := 1 + buckets*(1+fingerprintSize)
+	if len(msg) < want {
+		t.Fatalf("message of %d bytes, want at least %d for %d fingerprints", len(msg), want, buckets)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+
+	tests := []struct {
+		name               string
+		shared, ours, them int
+	}{
+		{"both empty", 0, 0, 0},
+		{"same small set", 10, 0, 0},
+		{"same large set", 500, 0, 0},
+		{"client empty", 0, 0, 100},
+		{"relay empty", 0, 100, 0},
+		{"small differences", 5, 3, 4},
+		{"large differences", 1000, 20, 30},
+		{"mostly different", 50, 400, 300},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			items := randomItems(tt.shared+tt.ours+tt.them, int64(i))
+
+			shared := items[:tt.shared]
+			ours := items[tt.shared : tt.shared+tt.ours]
+			theirs := items[tt.shared+tt.ours:]
+
+			client := New(append(append([]Item{}, shared...), ours...))
+			relay := New(append(append([]Item{}, shared...), theirs...))
+
+			have, need := reconcile(t, client, relay)
+
+			if got, want := sorted(have), hexIds(ours); !equal(got, want) {
+				t.Errorf("have %d ids, want %d", len(got), len(want))
+			}
+
+			if got, want := sorted(need), hexIds(theirs); !equal(got, want) {
+				t.Errorf("need %d ids, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestReconcileVersion(t *testing.T) {
+
+	// A relay speaking another version answers with the one it knows.
+	relay := New(nil)
+
+	out, _, _, err := relay.Reconcile([]byte{0x62})
+	if err != nil || !bytes.Equal(out, []byte{protocolVersion}) {
+		t.Fatalf("got %x, %v, want the supported version", out, err)
+	}
+
+	client := New(nil)
+	client.Initiate()
+
+	_, _, _, err = client.Reconcile([]byte{0x62})
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("got %v, want ErrUnsupportedVersion", err)
+	}
+
+	for _, msg := range []string{"", "50", "6100", "610000", "61000001", "6100000205"} {
+
+		raw, _ := hex.DecodeString(msg)
+
+		_, _, _, err := New(nil).Reconcile(raw)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%q: got %v, want ErrMalformed", msg, err)
+		}
+	}
+}
+
+// Run a client against a relay until the client is done.
+func reconcile(t *testing.T, client, relay *Negentropy) ([]string, []string) {
+
+	t.Helper()
+
+	have := []string{}
+	need := []string{}
+
+	msg := client.Initiate()
+
+	for rounds := 0; msg != nil; rounds++ {
+
+		if rounds > 50 {
+			t.Fatal("reconciliation does not end")
+		}
+
+		reply, _, _, err := relay.Reconcile(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next, h, n, err := client.Reconcile(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have = append(have, h...)
+		need = append(need, n...)
+		msg = next
+	}
+
+	return have, need
+}
+
+// Distinct items, a few of them sharing timestamps and id prefixes.
+func randomItems(n int, seed int64) []Item {
+
+	rng := rand.New(rand.NewSource(seed))
+
+	items := []Item{}
+	seen := make(map[[idSize]byte]bool)
+
+	for len(items) < n {
+
+		var item Item
+
+		item.Timestamp = uint64(1700000000 + rng.Intn(n/2+1))
+		rng.Read(item.Id[:])
+
+		// Same leading bytes as the previous item, so bounds need a prefix.
+		if len(items) > 0 && rng.Intn(4) == 0 {
+			prev := items[len(items)-1]
+			item.Timestamp = prev.Timestamp
+			copy(item.Id[:3], prev.Id[:3])
+		}
+
+		if seen[item.Id] {
+			continue
+		}
+		seen[item.Id] = true
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func mustItem(t *testing.T, timestamp int64, id string) Item {
+
+	t.Helper()
+
+	item, err := NewItem(timestamp, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return item
+}
+
+func hexIds(items []Item) []string {
+
+	ids := []string{}
+	for _, item := range items {
+		ids = append(ids, hex.EncodeToString(item.Id[:]))
+	}
+
+	return sorted(ids)
+}
+
+func sorted(ids []string) []string {
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+	return ids
+}
+
+func equal(a, b []string) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
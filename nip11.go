@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long a fetched relay information document is trusted.
+const relayInfoTTL = time.Hour
+
+// Give up on fetching a relay information document after this long.
+const relayInfoTimeout = 5 * time.Second
+
+// NIP-11 relay information document.
+type RelayInfo struct {
+	Name          string          `json:"name"`
+	Description   string          `json:"description"`
+	PubKey        string          `json:"pubkey"`
+	Contact       string          `json:"contact"`
+	SupportedNips []int           `json:"supported_nips"`
+	Software      string          `json:"software"`
+	Version       string          `json:"version"`
+	Limitation    RelayLimitation `json:"limitation"`
+
+	// When the document was fetched, not part of NIP-11.
+	FetchedAt time.Time `json:"-"`
+}
+
+type RelayLimitation struct {
+	MaxMessageLength int  `json:"max_message_length"`
+	MaxSubscriptions int  `json:"max_subscriptions"`
+	MaxFilters       int  `json:"max_filters"`
+	MaxLimit         int  `json:"max_limit"`
+	AuthRequired     bool `json:"auth_required"`
+	PaymentRequired  bool `json:"payment_required"`
+	RestrictedWrites bool `json:"restricted_writes"`
+}
+
+func (s *RelayInfo) Supports(nip int) bool {
+	for _, n := range s.SupportedNips {
+		if n == nip {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch the NIP-11 document served over HTTP on the relay's websocket address.
+func fetchRelayInfo(ctx context.Context, addr string) (*RelayInfo, error) {
+
+	url := addr
+	if strings.HasPrefix(url, "ws") {
+		url = "http" + strings.TrimPrefix(url, "ws")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/nostr+json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay information: %s", res.Status)
+	}
+
+	info := &RelayInfo{}
+
+	err = json.NewDecoder(res.Body).Decode(info)
+	if err != nil {
+		return nil, err
+	}
+
+	info.FetchedAt = time.Now()
+
+	return info, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/dextryz/nostr"
+)
+
+// NIP-19 TLV types.
+const (
+	tlvSpecial = 0
+	tlvRelay   = 1
+	tlvAuthor  = 2
+	tlvKind    = 3
+)
+
+// Decoded NIP-19 entity. Which fields are set depends on the prefix.
+type Entity struct {
+
+	// npub, note, nprofile, nevent or naddr
+	Prefix string
+
+	// Hex public key of the profile, event author or address author.
+	PubKey string
+
+	// Hex event id for note and nevent.
+	Id string
+
+	// Kind and d tag of an naddr, kind is optional in nevent.
+	Kind       uint32
+	Identifier string
+
+	// Whether the entity carries a kind, zero is a valid one.
+	HasKind bool
+
+	// Relay hints where the entity is likely to be found.
+	Relays []string
+}
+
+// Decode any NIP-19 entity, including the TLV encoded ones.
+func DecodeEntity(s string) (*Entity, error) {
+
+	prefix, data, err := bech32.DecodeNoLimit(s)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entity{Prefix: prefix}
+
+	switch prefix {
+	case "npub":
+		if len(bytes) != 32 {
+			return nil, fmt.Errorf("npub: invalid length %d", len(bytes))
+		}
+		e.PubKey = hex.EncodeToString(bytes)
+		return e, nil
+	case "note":
+		if len(bytes) != 32 {
+			return nil, fmt.Errorf("note: invalid length %d", len(bytes))
+		}
+		e.Id = hex.EncodeToString(bytes)
+		return e, nil
+	case "nprofile", "nevent", "naddr":
+	default:
+		return nil, fmt.Errorf("unsupported NIP-19 prefix %s", prefix)
+	}
+
+	// TLV: 1 byte type, 1 byte length, value.
+	for len(bytes) > 0 {
+
+		if len(bytes) < 2 || len(bytes) < 2+int(bytes[1]) {
+			return nil, fmt.Errorf("%s: truncated TLV", prefix)
+		}
+
+		t, v := bytes[0], bytes[2:2+int(bytes[1])]
+		bytes = bytes[2+int(bytes[1]):]
+
+		switch t {
+		case tlvSpecial:
+			switch prefix {
+			case "nprofile":
+				e.PubKey = hex.EncodeToString(v)
+			case "nevent":
+				e.Id = hex.EncodeToString(v)
+			case "naddr":
+				e.Identifier = string(v)
+			}
+		case tlvRelay:
+			e.Relays = append(e.Relays, string(v))
+		case tlvAuthor:
+			if prefix != "nprofile" {
+				e.PubKey = hex.EncodeToString(v)
+			}
+		case tlvKind:
+			if len(v) != 4 {
+				return nil, fmt.Errorf("%s: invalid kind length %d", prefix, len(v))
+			}
+			e.Kind = binary.BigEndian.Uint32(v)
+			e.HasKind = true
+		}
+	}
+
+	switch {
+	case prefix == "nprofile" && len(e.PubKey) != 64:
+		return nil, fmt.Errorf("nprofile: missing public key")
+	case prefix == "nevent" && len(e.Id) != 64:
+		return nil, fmt.Errorf("nevent: missing event id")
+	case prefix == "naddr" && (e.PubKey == "" || e.Kind == 0):
+		return nil, fmt.Errorf("naddr: missing author or kind")
+	}
+
+	return e, nil
+}
+
+// Whether the event is the one a note or nevent names: same id, and same
+// author and kind when the nevent carries them.
+func (s *Entity) matches(e *nostr.Event) bool {
+
+	if e.Id != s.Id {
+		return false
+	}
+
+	if s.PubKey != "" && e.PubKey != s.PubKey {
+		return false
+	}
+
+	if s.HasKind && e.Kind != s.Kind {
+		return false
+	}
+
+	return true
+}
+
+// Encode the address of a parameterized replaceable event as naddr.
+func EncodeAddress(pubkey string, kind uint32, identifier string, relays ...string) (string, error) {
+
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil || len(pk) != 32 {
+		return "", fmt.Errorf("naddr: invalid public key %q", pubkey)
+	}
+
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, kind)
+
+	tlv := []byte{}
+
+	tlv, err = appendTLV(tlv, tlvSpecial, []byte(identifier))
+	if err != nil {
+		return "", err
+	}
+
+	for _, relay := range relays {
+		tlv, err = appendTLV(tlv, tlvRelay, []byte(relay))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	tlv, _ = appendTLV(tlv, tlvAuthor, pk)
+	tlv, _ = appendTLV(tlv, tlvKind, k)
+
+	data, err := bech32.ConvertBits(tlv, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	return bech32.Encode("naddr", data)
+}
+
+func appendTLV(tlv []byte, t byte, v []byte) ([]byte, error) {
+
+	if len(v) > 255 {
+		return nil, fmt.Errorf("TLV value of %d bytes exceeds 255", len(v))
+	}
+
+	tlv = append(tlv, t, byte(len(v)))
+
+	return append(tlv, v...), nil
+}
+
+// Decode a NIP-19 entity, taking a bare hex id for the note it encodes.
+func parseEntity(s string) (*Entity, error) {
+
+	if isHex(s) {
+		return &Entity{Prefix: "note", Id: s}, nil
+	}
+
+	e, err := DecodeEntity(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+	}
+
+	return e, nil
+}
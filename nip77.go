@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dextryz/ixian/negentropy"
+	"github.com/dextryz/nostr"
+)
+
+var negId atomic.Int32
+
+var ErrNegentropy = errors.New("relay: negentropy error")
+
+// Reply from the relay within a negentropy session.
+type negReply struct {
+	msg []byte
+	err error
+}
+
+// Open negentropy sessions waiting for the relay, by subscription id.
+type negSessions struct {
+	mu      sync.Mutex
+	waiting map[string]chan negReply
+}
+
+func newNegSessions() *negSessions {
+	return &negSessions{
+		waiting: make(map[string]chan negReply),
+	}
+}
+
+func (s *negSessions) open(id string) chan negReply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan negReply, 1)
+	s.waiting[id] = ch
+	return ch
+}
+
+func (s *negSessions) close(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.waiting, id)
+}
+
+func (s *negSessions) deliver(id string, r negReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.waiting[id]
+	if !ok {
+		return
+	}
+	// The relay answers each of our messages once, so there is always room.
+	select {
+	case ch <- r:
+	default:
+	}
+}
+
+// Reconcile the local items with the events the relay holds for the
+// filter using NIP-77 negentropy. Returns the hex ids of the events only
+// the relay has.
+func (s *Connection) Reconcile(ctx context.Context, f nostr.Filter, items []negentropy.Item) ([]string, error) {
+
+	neg := negentropy.New(items)
+
+	id := "neg-" + strconv.Itoa(int(negId.Add(1)))
+
+	replies := s.neg.open(id)
+	defer s.neg.close(id)
+
+	err := s.send("NEG-OPEN", id, f, hex.EncodeToString(neg.Initiate()))
+	if err != nil {
+		return nil, &RelayError{Relay: s.url, Op: "negentropy", Err: err}
+	}
+
+	// Let the relay free the session, however it ended.
+	defer s.send("NEG-CLOSE", id)
+
+	need := []string{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, &RelayError{Relay: s.url, Op: "negentropy", Err: ctx.Err()}
+		case <-s.done:
+			return nil, &RelayError{Relay: s.url, Op: "negentropy", Err: ErrConnectionClosed}
+		case r := <-replies:
+
+			if r.err != nil {
+				return nil, &RelayError{Relay: s.url, Op: "negentropy", Err: r.err}
+			}
+
+			next, _, n, err := neg.Reconcile(r.msg)
+			if err != nil {
+				return nil, &RelayError{Relay: s.url, Op: "negentropy", Err: err}
+			}
+
+			need = append(need, n...)
+
+			if next == nil {
+				return need, nil
+			}
+
+			err = s.send("NEG-MSG", id, hex.EncodeToString(next))
+			if err != nil {
+				return nil, &RelayError{Relay: s.url, Op: "negentropy", Err: err}
+			}
+		}
+	}
+}
+
+// Marshal the elements as a relay message and write it to the socket.
+func (s *Connection) send(v ...any) error {
+
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.writeMessage(bytes)
+}
+
+// Relay reply in a negentropy session: ["NEG-MSG", <subid>, <hex message>]
+// or ["NEG-ERR", <subid>, <reason>]
+func (s *Connection) handleNeg(label string, fields []json.RawMessage) {
+
+	if len(fields) < 2 {
+		s.fail(label, errors.New("malformed message"))
+		return
+	}
+
+	var id, payload string
+	json.Unmarshal(fields[0], &id)
+	json.Unmarshal(fields[1], &payload)
+
+	if label == "NEG-ERR" {
+		s.neg.deliver(id, negReply{err: fmt.Errorf("%w: %s", ErrNegentropy, payload)})
+		return
+	}
+
+	msg, err := hex.DecodeString(payload)
+	if err != nil {
+		s.neg.deliver(id, negReply{err: err})
+		return
+	}
+
+	s.neg.deliver(id, negReply{msg: msg})
+}
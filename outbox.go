@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+// NIP-65 relay list metadata.
+const KindRelayList uint32 = 10002
+
+// Write relays queried per author. Relay lists are often far longer, and
+// the first few entries are the ones authors care about.
+const maxOutboxRelays = 4
+
+// How long an author's relay list is trusted before it is fetched again.
+const outboxTTL = time.Hour
+
+type outboxEntry struct {
+	relays    []string
+	fetchedAt time.Time
+}
+
+// Write relays per author pubkey.
+type outboxCache struct {
+	mu      sync.Mutex
+	entries map[string]outboxEntry
+}
+
+func newOutboxCache() *outboxCache {
+	return &outboxCache{
+		entries: make(map[string]outboxEntry),
+	}
+}
+
+func (s *outboxCache) get(pk string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[pk]
+	if !ok || time.Since(e.fetchedAt) > outboxTTL {
+		return nil, false
+	}
+	return e.relays, true
+}
+
+func (s *outboxCache) put(pk string, relays []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[pk] = outboxEntry{
+		relays:    relays,
+		fetchedAt: time.Now(),
+	}
+}
+
+// Write relays in a kind 10002 event: ["r", <url>] or ["r", <url>, "write"].
+// Entries marked "read" are where the author reads, not publishes.
+func writeRelays(e *nostr.Event) []string {
+
+	relays := []string{}
+
+	for _, t := range e.Tags {
+		if t.Key() != "r" || t.Value() == "" {
+			continue
+		}
+		if len(t) > 2 && t[2] == "read" {
+			continue
+		}
+		relays = append(relays, t.Value())
+		if len(relays) == maxOutboxRelays {
+			break
+		}
+	}
+
+	return relays
+}
+
+// Author's NIP-65 write relays, fetched from the given relays and cached.
+func (s *Repository) outboxRelays(ctx context.Context, relays []*Connection, pk string) []string {
+
+	if s.outbox == nil {
+		return nil
+	}
+
+	if cached, ok := s.outbox.get(pk); ok {
+		return cached
+	}
+
+	f := nostr.Filter{
+		Authors: []string{pk},
+		Kinds:   []uint32{KindRelayList},
+		Limit:   1,
+	}
+
+	res := s.fanOut(ctx, relays, f)
+
+	// Replaceable event, only the newest one counts.
+	var newest *nostr.Event
+	for _, e := range res.Events {
+		if newest == nil || e.CreatedAt > newest.CreatedAt {
+			newest = e
+		}
+	}
+
+	write := []string{}
+	if newest != nil {
+		write = writeRelays(newest)
+	}
+
+	s.outbox.put(pk, write)
+
+	return write
+}
+
+// Configured relays plus pooled connections to the hinted relays, without
+// duplicates. Call release once done with them.
+func (s *Repository) withHints(hints []string) ([]*Connection, func()) {
+
+	relays, release := s.Relays()
+
+	relays, releaseHints := s.addPooled(relays, hints)
+
+	return relays, releaseAll(release, releaseHints)
+}
+
+// Relays to query for an author: the configured relays, relay hints from
+// a NIP-19 entity, and the author's NIP-65 write relays. Call release once
+// done with them.
+func (s *Repository) relaysFor(ctx context.Context, pk string, hints []string) ([]*Connection, func()) {
+
+	relays, release := s.withHints(hints)
+
+	relays, releaseOutbox := s.addPooled(relays, s.outboxRelays(ctx, relays, pk))
+
+	return relays, releaseAll(release, releaseOutbox)
+}
+
+// Append pooled connections for the addresses that are not in relays yet.
+// Relays that cannot be reached are left out. Release covers only the
+// connections added.
+func (s *Repository) addPooled(relays []*Connection, addrs []string) ([]*Connection, func()) {
+
+	seen := make(map[string]struct{})
+	for _, ws := range relays {
+		key, err := NormalizeURL(ws.Url())
+		if err != nil {
+			key = ws.Url()
+		}
+		seen[key] = struct{}{}
+	}
+
+	keys := []string{}
+
+	for _, addr := range addrs {
+
+		key, err := NormalizeURL(addr)
+		if err != nil {
+			log.Printf("relay %s: skipping: %v", addr, err)
+			continue
+		}
+
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		keys = append(keys, key)
+	}
+
+	// Dial the new relays at the same time, each may take a while.
+	conns, release := s.pool.getAll(keys)
+
+	return append(relays, conns...), release
+}
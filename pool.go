@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPoolFull = errors.New("relay pool: all connections busy")
+var ErrPoolClosed = errors.New("relay pool: closed")
+
+// Connections to relays, opened on first use. This covers the configured
+// relays as well as ones found on the way, such as an author's NIP-65 write
+// relays. Connections are reused by normalized URL, capped in number, and
+// closed once idle.
+type RelayPool struct {
+	mu    sync.Mutex
+	conns map[string]*pooled
+
+	// Relays from the config with their options, by normalized URL, in
+	// config order.
+	configured map[string]RelayOptions
+	order      []string
+
+	// Private key used to answer NIP-42 challenges of configured relays
+	// that allow auth.
+	sk string
+
+	// Most connections open at once.
+	max int
+
+	// Close connections nobody holds unused for this long.
+	idle time.Duration
+
+	done chan struct{}
+}
+
+type pooled struct {
+	conn     *Connection
+	lastUsed time.Time
+
+	// Callers holding the connection from Get that have not released it
+	// yet. Never evicted while above zero.
+	inUse int
+}
+
+func NewRelayPool(max int, idle time.Duration) *RelayPool {
+
+	pool := &RelayPool{
+		conns:      make(map[string]*pooled),
+		configured: make(map[string]RelayOptions),
+		max:        max,
+		idle:       idle,
+		done:       make(chan struct{}),
+	}
+
+	go pool.evictLoop()
+
+	return pool
+}
+
+// Answer NIP-42 challenges with this key on configured relays that allow
+// auth. Call before the first Get.
+func (s *RelayPool) EnableAuth(sk string) {
+	s.sk = sk
+}
+
+// Register a relay from the config. Nothing is dialed until it is used.
+func (s *RelayPool) Configure(addr string, opts RelayOptions) error {
+
+	key, err := NormalizeURL(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.configured[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.configured[key] = opts
+
+	return nil
+}
+
+// Normalized URLs of the configured relays, in config order.
+func (s *RelayPool) ConfiguredURLs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.order...)
+}
+
+// Connections to every configured relay, dialing the ones not open yet at
+// the same time. Relays that cannot be dialed are logged and left out.
+// Call release once done with them, see Get.
+func (s *RelayPool) Configured() ([]*Connection, func()) {
+	return s.getAll(s.ConfiguredURLs())
+}
+
+// Connections to the relays, dialed at the same time. Relays that cannot
+// be dialed are logged and left out. Call release once done with them.
+func (s *RelayPool) getAll(keys []string) ([]*Connection, func()) {
+
+	conns := make([]*Connection, len(keys))
+	releases := make([]func(), len(keys))
+
+	var wg sync.WaitGroup
+
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			ws, release, err := s.Get(key)
+			if err != nil {
+				log.Printf("relay %s: unable to connect: %v", key, err)
+				return
+			}
+			conns[i] = ws
+			releases[i] = release
+		}(i, key)
+	}
+
+	wg.Wait()
+
+	relays := []*Connection{}
+	for _, ws := range conns {
+		if ws != nil {
+			relays = append(relays, ws)
+		}
+	}
+
+	return relays, releaseAll(releases...)
+}
+
+// Single release for several connections, nil entries are skipped.
+func releaseAll(releases ...func()) func() {
+	return func() {
+		for _, release := range releases {
+			if release != nil {
+				release()
+			}
+		}
+	}
+}
+
+// Lowercase scheme and host, drop default ports and trailing slashes, so
+// wss://Relay.example.com/ and wss://relay.example.com:443 share a socket.
+func NormalizeURL(addr string) (string, error) {
+
+	u, err := url.Parse(strings.TrimSpace(addr))
+	if err != nil {
+		return "", err
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", fmt.Errorf("relay url %q: scheme must be ws or wss", addr)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", fmt.Errorf("relay url %q: missing host", addr)
+	}
+
+	port := u.Port()
+	if (u.Scheme == "wss" && port == "443") || (u.Scheme == "ws" && port == "80") {
+		port = ""
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+
+	u.Host = host
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.Fragment = ""
+
+	return u.String(), nil
+}
+
+// Connection to the relay, dialing it if there is none yet. It is not
+// evicted until release is called, so a query, publish or reconciliation
+// in progress keeps its socket. Release is safe to call more than once.
+func (s *RelayPool) Get(addr string) (*Connection, func(), error) {
+
+	key, err := NormalizeURL(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cc, ok := s.lookup(key); ok {
+		return cc, s.releaser(key, cc), nil
+	}
+
+	s.mu.Lock()
+	opts, configured := s.configured[key]
+	s.mu.Unlock()
+
+	// Dial without holding the lock, a slow relay should not stall the others.
+	cc := NewConnection(key)
+
+	if configured {
+		if opts.Auth && s.sk != "" {
+			cc.EnableAuth(s.sk)
+		}
+		cc.SetReadOnly(opts.ReadOnly)
+	}
+
+	err = cc.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A configured relay that is down keeps reconnecting in the background
+	// and is skipped by queries meanwhile. Others are not worth retrying.
+	if !configured && !cc.Healthy() {
+		cc.Close()
+		return nil, nil, &RelayError{Relay: key, Op: "dial", Err: ErrNotConnected}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Shut down while dialing.
+	select {
+	case <-s.done:
+		cc.Close()
+		return nil, nil, ErrPoolClosed
+	default:
+	}
+
+	// Someone else dialed the same relay in the meantime.
+	if p, ok := s.conns[key]; ok {
+		cc.Close()
+		p.lastUsed = time.Now()
+		p.inUse++
+		return p.conn, s.releaser(key, p.conn), nil
+	}
+
+	if len(s.conns) >= s.max && !s.evictOldest() {
+		cc.Close()
+		return nil, nil, ErrPoolFull
+	}
+
+	s.conns[key] = &pooled{
+		conn:     cc,
+		lastUsed: time.Now(),
+		inUse:    1,
+	}
+
+	go watch(cc)
+
+	return cc, s.releaser(key, cc), nil
+}
+
+// Hand the connection back to the pool, once.
+func (s *RelayPool) releaser(key string, cc *Connection) func() {
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			// Evicted or replaced after a pool shutdown, nothing to count.
+			p, ok := s.conns[key]
+			if !ok || p.conn != cc {
+				return
+			}
+
+			p.inUse--
+			p.lastUsed = time.Now()
+		})
+	}
+}
+
+// Log relay failures until the connection is closed, instead of stopping
+// the server.
+func watch(cc *Connection) {
+	for {
+		select {
+		case <-cc.done:
+			return
+		case err := <-cc.Errors():
+			log.Println(err)
+		}
+	}
+}
+
+func (s *RelayPool) lookup(key string) (*Connection, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.conns[key]
+	if !ok {
+		return nil, false
+	}
+
+	p.lastUsed = time.Now()
+	p.inUse++
+
+	return p.conn, true
+}
+
+// Whether nobody holds the connection and it has no open subscription.
+func (p *pooled) idle() bool {
+	return p.inUse == 0 && p.conn.Subscriptions() == 0
+}
+
+// Close the least recently used connection that is idle.
+// The caller must hold s.mu.
+func (s *RelayPool) evictOldest() bool {
+
+	var oldest string
+	var at time.Time
+
+	for key, p := range s.conns {
+		if !p.idle() {
+			continue
+		}
+		if oldest == "" || p.lastUsed.Before(at) {
+			oldest, at = key, p.lastUsed
+		}
+	}
+
+	if oldest == "" {
+		return false
+	}
+
+	s.conns[oldest].conn.Close()
+	delete(s.conns, oldest)
+
+	return true
+}
+
+func (s *RelayPool) evictLoop() {
+
+	ticker := time.NewTicker(s.idle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for key, p := range s.conns {
+			if p.idle() && time.Since(p.lastUsed) > s.idle {
+				p.conn.Close()
+				delete(s.conns, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close every pooled connection and stop evicting.
+func (s *RelayPool) Close() {
+
+	close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, p := range s.conns {
+		p.conn.Close()
+		delete(s.conns, key)
+	}
+}
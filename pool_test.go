@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolKeepsConnectionsInUse(t *testing.T) {
+
+	slow := testRelay(t)
+	other := testRelay(t)
+
+	// Room for one socket, idle ones evicted right away.
+	pool := NewRelayPool(1, 20*time.Millisecond)
+	defer pool.Close()
+
+	err := pool.Configure(slow.URL, RelayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Repository{pool: pool, timeout: 5 * time.Second}
+
+	type published struct {
+		results []PublishResult
+		err     error
+	}
+
+	done := make(chan published, 1)
+
+	// The relay holds the OK back while the pool is under pressure.
+	slow.SetDelay(500 * time.Millisecond)
+
+	go func() {
+		_, results, err := s.Publish(context.Background(), signedEvent(t, 1, "hello", 100), testSk)
+		done <- published{results, err}
+	}()
+
+	eventually(t, "publish sent", func() bool {
+		return slow.Clients() == 1
+	})
+
+	// Neither the cap nor the idle timeout may close the socket in use.
+	_, _, err = pool.Get(other.URL)
+	if !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("got %v, want ErrPoolFull while the publish is pending", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	if len(res.results) != 1 || res.results[0].Status != PublishAccepted {
+		t.Fatalf("results %+v, want accepted", res.results)
+	}
+
+	// Released, so the idle connection goes.
+	eventually(t, "idle connection evicted", func() bool {
+		return slow.Clients() == 0
+	})
+
+	_, release, err := pool.Get(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,644 @@
+// Package relaytest provides an in-process NIP-01 relay for tests, in the
+// spirit of net/http/httptest. It serves a websocket on a local listener,
+// answers REQ from seeded events, accepts published events, optionally
+// speaks NIP-77 negentropy, and can inject faults such as delays, dropped
+// sockets and malformed messages.
+package relaytest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dextryz/ixian/negentropy"
+	"github.com/dextryz/nostr"
+	"github.com/gorilla/websocket"
+)
+
+type Relay struct {
+	server *httptest.Server
+
+	// Websocket address of the relay, ws://127.0.0.1:<port>
+	URL string
+
+	mu sync.Mutex
+
+	// Events served to REQ and extended by published EVENTs.
+	events []nostr.Event
+
+	// Connected clients and their open subscriptions.
+	clients map[*client]struct{}
+
+	// Every raw message received from clients, in order.
+	received [][]byte
+
+	// Fault injection, see SetDelay, SetNoEOSE and SetReject.
+	delay  time.Duration
+	noEose bool
+	reject string
+
+	// NIP-42 challenge sent to new clients, see RequireAuth.
+	challenge string
+
+	// NIP-11 document served to plain HTTP requests, see SetInfo.
+	info any
+
+	// Answer NIP-77 negentropy sessions, see SetNegentropy.
+	negentropy bool
+}
+
+type client struct {
+
+	// Gorilla allows only one concurrent writer.
+	mu     sync.Mutex
+	socket *websocket.Conn
+
+	// Open subscriptions by id.
+	subs map[string][]filter
+
+	// Set once the client answered the NIP-42 challenge.
+	authed bool
+
+	// Open negentropy sessions by id.
+	negs map[string]*negentropy.Negentropy
+}
+
+func (c *client) write(raw []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.socket.WriteMessage(websocket.TextMessage, raw)
+}
+
+func (c *client) send(v ...any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(raw)
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Start a relay seeded with the given events. Close it when done.
+func NewRelay(events ...nostr.Event) *Relay {
+
+	r := &Relay{
+		events:  events,
+		clients: make(map[*client]struct{}),
+	}
+
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	r.URL = "ws" + strings.TrimPrefix(r.server.URL, "http")
+
+	return r
+}
+
+// Add events to the store. They are served to subsequent REQs.
+func (r *Relay) Seed(events ...nostr.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, events...)
+}
+
+// Events currently held by the relay, including published ones.
+func (r *Relay) Events() []nostr.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]nostr.Event{}, r.events...)
+}
+
+// Raw messages received from clients so far.
+func (r *Relay) Received() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte{}, r.received...)
+}
+
+// Number of subscriptions currently open across all clients.
+func (r *Relay) Subscriptions() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for c := range r.clients {
+		n += len(c.subs)
+	}
+	return n
+}
+
+// Number of connected clients.
+func (r *Relay) Clients() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
+
+// Wait before answering each client message.
+func (r *Relay) SetDelay(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = d
+}
+
+// Stop sending EOSE, like a relay that hangs on a query.
+func (r *Relay) SetNoEOSE(noEose bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.noEose = noEose
+}
+
+// Reject published events with this OK message. Empty accepts them.
+func (r *Relay) SetReject(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reject = msg
+}
+
+// Require NIP-42 authentication. New clients are sent the challenge on
+// connect and REQs from unauthenticated clients are refused with CLOSED.
+func (r *Relay) RequireAuth(challenge string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.challenge = challenge
+}
+
+// Serve v as the NIP-11 relay information document.
+func (r *Relay) SetInfo(v any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.info = v
+}
+
+// Answer NIP-77 NEG-OPEN and NEG-MSG. Relays without it reply to them
+// with a NOTICE.
+func (r *Relay) SetNegentropy(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.negentropy = enabled
+}
+
+// Send a NOTICE to every connected client.
+func (r *Relay) Notice(msg string) {
+	r.broadcast("NOTICE", msg)
+}
+
+// Send a raw message, valid or not, to every connected client.
+func (r *Relay) SendRaw(raw []byte) {
+	for _, c := range r.snapshot() {
+		c.write(raw)
+	}
+}
+
+// Drop every client socket without a close handshake.
+func (r *Relay) Disconnect() {
+	for _, c := range r.snapshot() {
+		c.socket.Close()
+	}
+}
+
+// Disconnect all clients and stop the server.
+func (r *Relay) Close() {
+	r.Disconnect()
+	r.server.Close()
+}
+
+func (r *Relay) snapshot() []*client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]*client, 0, len(r.clients))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (r *Relay) broadcast(v ...any) {
+	for _, c := range r.snapshot() {
+		c.send(v...)
+	}
+}
+
+func (r *Relay) serve(w http.ResponseWriter, req *http.Request) {
+
+	// NIP-11 is served on the same address to non-websocket requests.
+	if !websocket.IsWebSocketUpgrade(req) {
+		r.serveInfo(w, req)
+		return
+	}
+
+	socket, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+
+	c := &client{
+		socket: socket,
+		subs:   make(map[string][]filter),
+		negs:   make(map[string]*negentropy.Negentropy),
+	}
+
+	r.mu.Lock()
+	r.clients[c] = struct{}{}
+	challenge := r.challenge
+	r.mu.Unlock()
+
+	if challenge != "" {
+		c.send("AUTH", challenge)
+	}
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.clients, c)
+		r.mu.Unlock()
+		socket.Close()
+	}()
+
+	for {
+		_, raw, err := socket.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		r.received = append(r.received, raw)
+		delay := r.delay
+		r.mu.Unlock()
+
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		r.handle(c, raw)
+	}
+}
+
+func (r *Relay) serveInfo(w http.ResponseWriter, req *http.Request) {
+
+	r.mu.Lock()
+	info := r.info
+	r.mu.Unlock()
+
+	if info == nil || req.Header.Get("Accept") != "application/nostr+json" {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/nostr+json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (r *Relay) handle(c *client, raw []byte) {
+
+	var msg []json.RawMessage
+
+	err := json.Unmarshal(raw, &msg)
+	if err != nil || len(msg) < 2 {
+		c.send("NOTICE", "invalid: malformed message")
+		return
+	}
+
+	var label, id string
+	json.Unmarshal(msg[0], &label)
+
+	r.mu.Lock()
+	negEnabled := r.negentropy
+	r.mu.Unlock()
+
+	if strings.HasPrefix(label, "NEG-") && negEnabled {
+		r.handleNeg(c, label, msg)
+		return
+	}
+
+	switch label {
+	case "REQ":
+
+		json.Unmarshal(msg[1], &id)
+
+		filters := []filter{}
+		for _, f := range msg[2:] {
+			filters = append(filters, decodeFilter(f))
+		}
+
+		r.mu.Lock()
+		if r.challenge != "" && !c.authed {
+			r.mu.Unlock()
+			c.send("CLOSED", id, "auth-required: authenticate to read")
+			return
+		}
+		c.subs[id] = filters
+		matched := r.query(filters)
+		noEose := r.noEose
+		r.mu.Unlock()
+
+		for _, e := range matched {
+			c.send("EVENT", id, e)
+		}
+
+		if !noEose {
+			c.send("EOSE", id)
+		}
+
+	case "CLOSE":
+
+		json.Unmarshal(msg[1], &id)
+
+		r.mu.Lock()
+		delete(c.subs, id)
+		r.mu.Unlock()
+
+	case "EVENT":
+
+		var e nostr.Event
+
+		err := json.Unmarshal(msg[1], &e)
+		if err != nil {
+			c.send("NOTICE", "invalid: malformed event")
+			return
+		}
+
+		r.mu.Lock()
+		reject := r.reject
+		if reject == "" {
+			r.events = append(r.events, e)
+		}
+		r.mu.Unlock()
+
+		c.send("OK", e.Id, reject == "", reject)
+
+		if reject == "" {
+			r.fanout(e)
+		}
+
+	case "AUTH":
+
+		var e nostr.Event
+
+		err := json.Unmarshal(msg[1], &e)
+		if err != nil {
+			c.send("NOTICE", "invalid: malformed auth event")
+			return
+		}
+
+		r.mu.Lock()
+		ok := e.Kind == 22242 && r.challenge != "" && hasTag(e, "challenge", r.challenge)
+		if ok {
+			c.authed = true
+		}
+		r.mu.Unlock()
+
+		if !ok {
+			c.send("OK", e.Id, false, "invalid: bad challenge")
+			return
+		}
+
+		c.send("OK", e.Id, true, "")
+
+	default:
+		c.send("NOTICE", "unsupported: "+label)
+	}
+}
+
+// NIP-77 session: ["NEG-OPEN", <subid>, <filter>, <hex message>],
+// ["NEG-MSG", <subid>, <hex message>] and ["NEG-CLOSE", <subid>]
+func (r *Relay) handleNeg(c *client, label string, msg []json.RawMessage) {
+
+	var id string
+	json.Unmarshal(msg[1], &id)
+
+	var payload string
+
+	switch label {
+	case "NEG-OPEN":
+
+		if len(msg) < 4 {
+			c.send("NEG-ERR", id, "invalid: malformed NEG-OPEN")
+			return
+		}
+
+		f := decodeFilter(msg[2])
+		json.Unmarshal(msg[3], &payload)
+
+		r.mu.Lock()
+		items := []negentropy.Item{}
+		for _, e := range r.query([]filter{f}) {
+			item, err := negentropy.NewItem(int64(e.CreatedAt), e.Id)
+			if err == nil {
+				items = append(items, item)
+			}
+		}
+		c.negs[id] = negentropy.New(items)
+		r.mu.Unlock()
+
+	case "NEG-MSG":
+
+		if len(msg) < 3 {
+			c.send("NEG-ERR", id, "invalid: malformed NEG-MSG")
+			return
+		}
+
+		json.Unmarshal(msg[2], &payload)
+
+	case "NEG-CLOSE":
+
+		r.mu.Lock()
+		delete(c.negs, id)
+		r.mu.Unlock()
+
+		return
+
+	default:
+		c.send("NOTICE", "unsupported: "+label)
+		return
+	}
+
+	r.mu.Lock()
+	neg, ok := c.negs[id]
+	r.mu.Unlock()
+
+	if !ok {
+		c.send("NEG-ERR", id, "closed: no such session")
+		return
+	}
+
+	raw, err := hex.DecodeString(payload)
+	if err != nil {
+		c.send("NEG-ERR", id, "invalid: message is not hex")
+		return
+	}
+
+	reply, _, _, err := neg.Reconcile(raw)
+	if err != nil {
+		c.send("NEG-ERR", id, "invalid: "+err.Error())
+		return
+	}
+
+	c.send("NEG-MSG", id, hex.EncodeToString(reply))
+}
+
+// Push a newly published event to matching open subscriptions.
+func (r *Relay) fanout(e nostr.Event) {
+
+	type match struct {
+		c  *client
+		id string
+	}
+
+	r.mu.Lock()
+	matches := []match{}
+	for c := range r.clients {
+		for id, filters := range c.subs {
+			for _, f := range filters {
+				if f.matches(e) {
+					matches = append(matches, match{c, id})
+					break
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, m := range matches {
+		m.c.send("EVENT", m.id, e)
+	}
+}
+
+// Stored events matching any of the filters, newest first.
+// The caller must hold r.mu.
+func (r *Relay) query(filters []filter) []nostr.Event {
+
+	matched := []nostr.Event{}
+
+	for _, f := range filters {
+		n := 0
+		for _, e := range r.sorted() {
+			if f.Limit > 0 && n >= f.Limit {
+				break
+			}
+			if f.matches(e) {
+				matched = append(matched, e)
+				n++
+			}
+		}
+	}
+
+	return matched
+}
+
+func (r *Relay) sorted() []nostr.Event {
+	events := append([]nostr.Event{}, r.events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt > events[j].CreatedAt
+	})
+	return events
+}
+
+// NIP-01 filter as it appears on the wire.
+type filter struct {
+	Ids     []string
+	Authors []string
+	Kinds   []uint32
+	Tags    map[string][]string
+	Since   int64
+	Until   int64
+	Limit   int
+}
+
+func decodeFilter(raw json.RawMessage) filter {
+
+	f := filter{Tags: make(map[string][]string)}
+
+	var fields map[string]json.RawMessage
+	json.Unmarshal(raw, &fields)
+
+	for k, v := range fields {
+		switch {
+		case k == "ids":
+			json.Unmarshal(v, &f.Ids)
+		case k == "authors":
+			json.Unmarshal(v, &f.Authors)
+		case k == "kinds":
+			json.Unmarshal(v, &f.Kinds)
+		case k == "since":
+			json.Unmarshal(v, &f.Since)
+		case k == "until":
+			json.Unmarshal(v, &f.Until)
+		case k == "limit":
+			json.Unmarshal(v, &f.Limit)
+		case strings.HasPrefix(k, "#"):
+			var values []string
+			json.Unmarshal(v, &values)
+			f.Tags[k[1:]] = values
+		}
+	}
+
+	return f
+}
+
+func (f filter) matches(e nostr.Event) bool {
+
+	if len(f.Ids) > 0 && !contains(f.Ids, e.Id) {
+		return false
+	}
+
+	if len(f.Authors) > 0 && !contains(f.Authors, e.PubKey) {
+		return false
+	}
+
+	if len(f.Kinds) > 0 {
+		found := false
+		for _, k := range f.Kinds {
+			if k == e.Kind {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Since > 0 && int64(e.CreatedAt) < f.Since {
+		return false
+	}
+
+	if f.Until > 0 && int64(e.CreatedAt) > f.Until {
+		return false
+	}
+
+	for key, values := range f.Tags {
+		found := false
+		for _, t := range e.Tags {
+			if t.Key() == key && contains(values, t.Value()) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasTag(e nostr.Event, key, value string) bool {
+	for _, t := range e.Tags {
+		if t.Key() == key && t.Value() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
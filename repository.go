@@ -2,174 +2,613 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dextryz/nostr"
 )
 
+var ErrNotFound = errors.New("not found on any relay")
+var ErrInvalidEntity = errors.New("invalid NIP-19 entity")
+var ErrNotList = errors.New("not a NIP-51 categorized people list")
+
+// How long a query waits for relays to send EOSE before dropping them.
+const DefaultQueryTimeout = 5 * time.Second
+
 // Abstracts the connection between the local databases and relays.
 type Repository struct {
 	db *Db
-	ws []*Connection
+
+	// Connections to the configured relays and any others, dialed on first use.
+	pool *RelayPool
+
+	// Authors' NIP-65 write relays.
+	outbox *outboxCache
+
+	// Per-query deadline for relays to answer.
+	timeout time.Duration
+
+	// Age after which cached entities are refreshed in the background.
+	ttl time.Duration
+
+	// Background refreshes in progress, nil to never refresh in the background.
+	revalidating *revalidator
 }
 
+// Close all relay connections, ending their subscriptions, then the database
+// once the background refreshes gave up on them.
 func (s *Repository) Close() error {
 
-	// 1. Close all WS connections.
+	s.pool.Close()
 
-	// 2. Close database connection.
+	if s.revalidating != nil {
+		s.revalidating.wait()
+	}
 
-	return nil
+	return s.db.Close()
 }
 
-// Retrieve article from local cache.
-func (s *Repository) Profile(pubkey string) (*Profile, error) {
+// Connections to the configured relays, dialing the ones not open yet.
+// Call release once done with them.
+func (s *Repository) Relays() ([]*Connection, func()) {
+	return s.pool.Configured()
+}
 
-	// TODO: Convert to filter to send to database
+// Profile by npub or nprofile, see ProfileByPubkey.
+func (s *Repository) Profile(ctx context.Context, nid string) (*Profile, error) {
 
-	profile, err := s.db.queryProfileByPubkey(pubkey)
+	entity, err := parseEntity(nid)
 	if err != nil {
 		return nil, err
 	}
 
-	return profile, nil
+	if entity.Prefix != "npub" && entity.Prefix != "nprofile" {
+		return nil, fmt.Errorf("%w: %s is not a profile", ErrInvalidEntity, entity.Prefix)
+	}
+
+	return s.ProfileByPubkey(ctx, entity.PubKey, entity.Relays...)
 }
 
-func (s *Repository) ProfileByArticle(id string) (*Profile, error) {
+// Profile by hex pubkey, cache first. It is pulled from the relay hints,
+// the configured relays and the author's write relays, see cacheFirst.
+func (s *Repository) ProfileByPubkey(ctx context.Context, pk string, hints ...string) (*Profile, error) {
 
-	profile, err := s.db.queryProfileByArticle(id)
+	npub, err := nostr.EncodePublicKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+	}
+
+	read := func(ctx context.Context) (*Profile, bool, error) {
+		profile, err := s.db.queryProfileByPubkey(ctx, npub)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return profile, err == nil, err
+	}
+
+	fetch := func(ctx context.Context) error {
+
+		relays, release := s.relaysFor(ctx, pk, hints)
+		defer release()
+
+		_, err := s.refreshProfile(ctx, relays, pk)
+		return err
+	}
+
+	return cacheFirst(ctx, s, profileKey(npub), read, fetch)
+}
+
+// Profile of the article's author by naddr, from the cache only. Authors
+// not pulled yet are left blank, see ArticleByTag.
+func (s *Repository) ProfileByArticle(ctx context.Context, id string) (*Profile, error) {
+
+	p, err := s.db.queryProfileByArticle(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &Profile{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return profile, nil
+	return p, nil
 }
 
-// Retrieve article from local cache.
-func (s *Repository) Article(nid string) (*Article, error) {
+// Retrieve the current version of an article, by naddr or by the note,
+// nevent or hex id of any of its versions, cache first. It is pulled from
+// the relay hints, the configured relays and the author's write relays,
+// see cacheFirst.
+func (s *Repository) Article(ctx context.Context, nid string) (*Article, error) {
 
-	article, err := s.db.queryArticleById(nid)
+	address, err := s.address(ctx, nid)
 	if err != nil {
 		return nil, err
 	}
 
-	return article, nil
+	// Drop the relay hints, articles are stored by the bare address.
+	naddr, err := EncodeAddress(address.PubKey, address.Kind, address.Identifier)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+	}
+
+	f := nostr.Filter{
+		Authors: []string{address.PubKey},
+		Kinds:   []uint32{address.Kind},
+		Tags:    map[string][]string{"d": {address.Identifier}},
+		Limit:   s.db.QueryLimit,
+	}
+
+	read := func(ctx context.Context) (*Article, bool, error) {
+		articles, err := s.db.QueryArticles(ctx, f)
+		if err != nil || len(articles) == 0 {
+			return nil, false, err
+		}
+		return articles[0], true, nil
+	}
+
+	fetch := func(ctx context.Context) error {
+
+		relays, release := s.relaysFor(ctx, address.PubKey, address.Relays)
+		defer release()
+
+		res := s.fanOut(ctx, relays, f)
+
+		if len(res.Events) == 0 {
+			return fmt.Errorf("%w: article %s", ErrNotFound, naddr)
+		}
+
+		// Relays may still hold older versions, the newest is kept current.
+		for _, e := range res.Events {
+			_, err := s.db.StoreArticle(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return cacheFirst(ctx, s, articleKey(naddr), read, fetch)
 }
 
-func (s *Repository) ArticleByTag(tag string) ([]*Article, error) {
+// Address of an article from its naddr, or from the note, nevent or hex id
+// of one of its versions.
+func (s *Repository) address(ctx context.Context, nid string) (*Entity, error) {
 
-	articles, err := s.db.queryArticleByTag(tag)
+	entity, err := parseEntity(nid)
 	if err != nil {
 		return nil, err
 	}
 
-	return articles, nil
+	switch entity.Prefix {
+	case "naddr":
+		if entity.Kind != nostr.KindArticle {
+			return nil, fmt.Errorf("%w: kind %d is not an article", ErrInvalidEntity, entity.Kind)
+		}
+		return entity, nil
+	case "note", "nevent":
+		e, err := s.FindEvent(ctx, entity)
+		if err != nil {
+			return nil, err
+		}
+		if e.Kind != nostr.KindArticle {
+			return nil, fmt.Errorf("%w: event %s has kind %d", ErrInvalidEntity, e.Id, e.Kind)
+		}
+		return &Entity{
+			Prefix:     "naddr",
+			PubKey:     e.PubKey,
+			Kind:       e.Kind,
+			Identifier: identifier(e),
+			Relays:     entity.Relays,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s is not an article", ErrInvalidEntity, entity.Prefix)
 }
 
-func (s *Repository) FindArticles(npub string) (*Profile, []*Article, error) {
+// One cached version of an article.
+type Revision struct {
+
+	// Hex event id of the version.
+	Id string
+
+	// Hex event id of the version this one replaced, empty for the first.
+	Previous string
+
+	CreatedAt string
+	Title     string
+	MdContent string
+}
 
-	ctx := context.Background()
+// Every cached version of an article, newest first.
+func (s *Repository) History(ctx context.Context, nid string) ([]*Revision, error) {
 
-	// Retrieve all NIP-23 articles from nostr relays
-	events, err := s.reqRelays(npub, nostr.KindArticle)
+	address, err := s.address(ctx, nid)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Retrieve user profile from nostr relays
-	metadata, err := s.reqRelays(npub, nostr.KindSetMetadata)
+	events, err := s.db.queryVersions(ctx, address.PubKey, address.Kind, address.Identifier)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	if len(events) == 0 {
+		return nil, fmt.Errorf("%w: article %s", ErrNotFound, nid)
+	}
+
+	revisions := []*Revision{}
+
+	for _, e := range events {
+
+		r := &Revision{
+			Id:        e.Id,
+			CreatedAt: time.Unix(int64(e.CreatedAt), 0).Format("2006-01-02 15:04"),
+			MdContent: e.Content,
+		}
+
+		for _, t := range e.Tags {
+			if t.Key() == "title" {
+				r.Title = t.Value()
+			}
+		}
+
+		revisions = append(revisions, r)
+	}
+
+	for i := 0; i+1 < len(revisions); i++ {
+		revisions[i].Previous = revisions[i+1].Id
 	}
 
-	// Only one profile can be pulled per pubkey.
-	p, err := nostr.ParseMetadata(*metadata[0])
+	return revisions, nil
+}
+
+// Signed event named by a note or nevent from the local cache, pulled from
+// the relay hints and the configured relays if missing. The author's write
+// relays are asked too when the nevent names the author.
+func (s *Repository) FindEvent(ctx context.Context, entity *Entity) (*nostr.Event, error) {
+
+	event, err := s.db.queryEvent(ctx, entity.Id)
+	if err == nil && !entity.matches(event) {
+		return nil, fmt.Errorf("%w: event %s", ErrNotFound, entity.Id)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return event, err
+	}
+
+	relays, release := s.withHints(entity.Relays)
+	if entity.PubKey != "" {
+		release()
+		relays, release = s.relaysFor(ctx, entity.PubKey, entity.Relays)
+	}
+	defer release()
+
+	f := nostr.Filter{
+		Ids:   []string{entity.Id},
+		Limit: 1,
+	}
+
+	res := s.fanOut(ctx, relays, f)
+
+	// Relays may answer with any event, only the one named counts.
+	event = nil
+	for _, e := range res.Events {
+		if entity.matches(e) {
+			event = e
+			break
+		}
+	}
+
+	if event == nil {
+		return nil, fmt.Errorf("%w: event %s", ErrNotFound, entity.Id)
+	}
+
+	switch event.Kind {
+	case nostr.KindArticle:
+		_, err = s.db.StoreArticle(ctx, event)
+	case nostr.KindSetMetadata:
+		_, err = s.db.StoreProfile(ctx, event)
+	default:
+		err = s.db.StoreEvent(ctx, event)
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	profile, err := s.db.StoreProfile(ctx, p, npub)
+	return event, nil
+}
+
+// Cached articles matching the full-text query with their author, best
+// match first. Relays are not asked, see Db.SearchArticles.
+func (s *Repository) Search(ctx context.Context, query string) ([]*Note, error) {
+
+	hits, err := s.db.SearchArticles(ctx, query, searchLimit)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Create article from event and profile, cache and return to handler.
-	articles := []*Article{}
-	for _, e := range events {
-		a, err := s.db.StoreArticle(ctx, e)
+	notes := []*Note{}
+
+	for _, hit := range hits {
+
+		// Articles pulled live can be cached before their author. Search
+		// stays local, the author is left blank.
+		p, err := s.ProfileByArticle(ctx, hit.Article.Id)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		articles = append(articles, a)
+
+		notes = append(notes, &Note{
+			Article: hit.Article,
+			Profile: p,
+			Snippet: hit.Snippet,
+		})
 	}
 
-	return profile, articles, nil
+	return notes, nil
 }
 
-func (s *Repository) CategorizedPeople(id string) (*nostr.Event, error) {
+// Articles with the hashtag, cache first. They are pulled from the
+// configured relays, see cacheFirst. The profiles of their authors missing
+// from the cache are pulled along, see ProfileByArticle.
+func (s *Repository) ArticleByTag(ctx context.Context, tag string) ([]*Article, error) {
 
 	f := nostr.Filter{
-		Ids:   []string{id},
-		Kinds: []uint32{3000},
+		Kinds: []uint32{nostr.KindArticle},
+		Tags:  map[string][]string{"t": {tag}},
 		Limit: s.db.QueryLimit,
 	}
 
-	events := []*nostr.Event{}
+	read := func(ctx context.Context) ([]*Article, bool, error) {
+		articles, err := s.db.QueryArticles(ctx, f)
+		return articles, len(articles) > 0, err
+	}
+
+	fetch := func(ctx context.Context) error {
+
+		relays, release := s.Relays()
+		defer release()
+
+		res := s.fanOut(ctx, relays, f)
+
+		for _, e := range res.Events {
+			_, err := s.db.StoreArticle(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	articles, err := cacheFirst(ctx, s, hashtagKey(tag), read, fetch)
+	if errors.Is(err, ErrNotFound) {
+		return []*Article{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// One query for the authors not cached yet instead of one per card.
+	authors := []string{}
+	seen := make(map[string]bool)
+
+	for _, a := range articles {
+
+		_, err := s.db.queryProfileByArticle(ctx, a.Id)
+		if !errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+
+		entity, err := parseEntity(a.Id)
+		if err != nil || seen[entity.PubKey] {
+			continue
+		}
+
+		seen[entity.PubKey] = true
+		authors = append(authors, entity.PubKey)
+	}
+
+	if len(authors) > 0 {
+		relays, release := s.Relays()
+		defer release()
+
+		s.refreshProfiles(ctx, relays, authors)
+	}
+
+	return articles, nil
+}
+
+// An author's articles and profile, cache first, see cacheFirst. The
+// articles are cached once the author was pulled, articles cached on
+// their own may be only some of them. Only articles missing from the cache
+// are downloaded, see syncArticles.
+// Besides the configured relays, the relay hints and the author's NIP-65
+// write relays are queried. Relays that do not answer before the query
+// deadline, or before ctx is cancelled, are listed as timed out in the
+// report and their events are missing from the result. The report is
+// empty when served from the cache.
+func (s *Repository) FindArticles(ctx context.Context, npub string, hints ...string) (*Profile, []*Article, *RelayReport, error) {
+
+	prefix, pk, err := nostr.DecodeBech32(npub)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+	}
+
+	if prefix != "npub" {
+		return nil, nil, nil, fmt.Errorf("%w: public key is not of NIP-19 standard", ErrInvalidEntity)
+	}
+
+	f := nostr.Filter{
+		Authors: []string{pk},
+		Kinds:   []uint32{nostr.KindArticle},
+	}
 
-	// Subscribe the PubKey to every open connection to a relay.
-	for _, ws := range s.ws {
+	type authorArticles struct {
+		profile  *Profile
+		articles []*Article
+	}
 
-		sub, err := ws.Subscribe(nostr.Filters{f})
+	read := func(ctx context.Context) (*authorArticles, bool, error) {
+
+		_, pulled, err := s.db.refreshedAt(ctx, authorKey(pk))
+		if err != nil || !pulled {
+			return nil, false, err
+		}
+
+		// Authors without a kind 0 on the relays are left blank.
+		profile, err := s.db.queryProfileByPubkey(ctx, npub)
+		if errors.Is(err, sql.ErrNoRows) {
+			profile, err = &Profile{PubKey: npub}, nil
+		}
 		if err != nil {
-			log.Fatalf("\nunable to subscribe: %#v", err)
+			return nil, false, err
 		}
 
-		orDone := func(done <-chan struct{}, stream <-chan *nostr.Event) <-chan *nostr.Event {
-			valStream := make(chan *nostr.Event)
-			go func() {
-				defer close(valStream)
-				for {
-					select {
-					case <-done:
-						return
-					case v, ok := <-stream:
-						if ok == false {
-							return
-						}
-						valStream <- v
-					}
-				}
-			}()
-			return valStream
+		articles, err := s.db.QueryArticles(ctx, f)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return &authorArticles{profile, articles}, true, nil
+	}
+
+	// Set by a synchronous fetch, a background one may outlive the call.
+	var synced atomic.Pointer[RelayReport]
+
+	fetch := func(ctx context.Context) error {
+
+		relays, release := s.relaysFor(ctx, pk, hints)
+		defer release()
+
+		// Retrieve the NIP-23 articles missing from the cache.
+		events := s.syncArticles(ctx, relays, pk)
+
+		// Create article from event and cache it.
+		for _, e := range events.Events {
+			_, err := s.db.StoreArticle(ctx, e)
+			if err != nil {
+				return err
+			}
 		}
 
-		for e := range orDone(sub.Done, sub.EventStream) {
-			events = append(events, e)
+		// Retrieve user profile from nostr relays, the articles are served
+		// without it when the relays have none.
+		_, err := s.refreshProfile(ctx, relays, pk)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			log.Printf("articles by %s: %v", npub, err)
+		case err != nil:
+			return err
+		default:
+			err = s.db.touch(ctx, profileKey(npub), time.Now())
+			if err != nil {
+				return err
+			}
 		}
 
-		//cc.Close()
+		synced.Store(&events.RelayReport)
+
+		return nil
+	}
+
+	// New and previously synced articles alike are served from the cache.
+	res, err := cacheFirst(ctx, s, authorKey(pk), read, fetch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	report := synced.Load()
+	if report == nil {
+		report = &RelayReport{Answered: []string{}, TimedOut: []string{}}
+	}
+
+	return res.profile, res.articles, report, nil
+}
+
+// NIP-51 categorized people list by note or nevent, see FindEvent.
+func (s *Repository) CategorizedPeople(ctx context.Context, entity *Entity) (*nostr.Event, error) {
+
+	e, err := s.FindEvent(ctx, entity)
+	if err != nil {
+		return nil, err
 	}
 
 	// Make sure the event is a NIP-51 list
-	e := events[0]
 	if e.Kind != 3000 {
-		log.Fatalln("not a NIP-51 categorized people list")
+		return nil, fmt.Errorf("%w: event %s has kind %d", ErrNotList, e.Id, e.Kind)
 	}
 
 	return e, nil
 }
 
-func (s *Repository) reqRelays(npub string, kind uint32) ([]*nostr.Event, error) {
+// Pull the author's kind 0 from every relay and keep the newest, relays
+// lagging behind may still serve an older one.
+func (s *Repository) refreshProfile(ctx context.Context, relays []*Connection, pk string) (*Profile, error) {
 
-	prefix, pk, err := nostr.DecodeBech32(npub)
+	npub, err := nostr.EncodePublicKey(pk)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
 	}
 
-	if prefix != "npub" {
-		return nil, fmt.Errorf("public key is not of NIP-19 standard")
+	metadata := s.reqRelays(ctx, relays, pk, nostr.KindSetMetadata)
+
+	if len(metadata.Events) == 0 {
+		return nil, fmt.Errorf("%w: profile %s", ErrNotFound, npub)
+	}
+
+	// The projection follows the newest kind 0 stored, by created_at.
+	for _, e := range metadata.Events {
+		_, err := s.db.StoreProfile(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.db.queryProfileByPubkey(ctx, npub)
+}
+
+// Pull the kind 0 of several authors at once. The cards are served
+// without the profiles that fail to store, so failures are only logged.
+func (s *Repository) refreshProfiles(ctx context.Context, relays []*Connection, pks []string) {
+
+	if len(pks) == 0 {
+		return
+	}
+
+	f := nostr.Filter{
+		Authors: pks,
+		Kinds:   []uint32{nostr.KindSetMetadata},
+		Limit:   s.db.QueryLimit,
+	}
+
+	res := s.fanOut(ctx, relays, f)
+
+	for _, e := range res.Events {
+
+		_, err := s.db.StoreProfile(ctx, e)
+		if err != nil {
+			log.Printf("profile %s: %v", e.PubKey, err)
+			continue
+		}
+
+		npub, err := nostr.EncodePublicKey(e.PubKey)
+		if err != nil {
+			continue
+		}
+
+		err = s.db.touch(ctx, profileKey(npub), time.Now())
+		if err != nil {
+			log.Printf("profile %s: %v", npub, err)
+		}
 	}
+}
+
+func (s *Repository) reqRelays(ctx context.Context, relays []*Connection, pk string, kind uint32) *QueryResult {
 
 	f := nostr.Filter{
 		Authors: []string{pk},
@@ -177,41 +616,269 @@ func (s *Repository) reqRelays(npub string, kind uint32) ([]*nostr.Event, error)
 		Limit:   s.db.QueryLimit,
 	}
 
-	events := []*nostr.Event{}
+	return s.fanOut(ctx, relays, f)
+}
 
-	// Subscribe the PubKey to every open connection to a relay.
-	for _, ws := range s.ws {
+type PublishStatus string
 
-		sub, err := ws.Subscribe(nostr.Filters{f})
-		if err != nil {
-			log.Fatalf("\nunable to subscribe: %#v", err)
+const (
+	PublishAccepted PublishStatus = "accepted"
+	PublishRejected PublishStatus = "rejected"
+	PublishTimeout  PublishStatus = "timeout"
+	PublishFailed   PublishStatus = "failed"
+)
+
+// Outcome of publishing an event to one relay.
+type PublishResult struct {
+	Relay  string
+	Status PublishStatus
+
+	// Message from the relay's OK, or the error that stopped the publish.
+	Message string
+}
+
+// Sign the event once and broadcast it to every write relay at the same
+// time. Each relay gets until the query deadline to answer with an OK.
+func (s *Repository) Publish(ctx context.Context, event nostr.Event, sk string) (*nostr.Event, []PublishResult, error) {
+
+	pub, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Add original author to event.
+	event.PubKey = pub
+
+	// We have to sign last, since the signature is dependent on the event content.
+	err = event.Sign(sk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make(chan PublishResult)
+
+	relays, release := s.Relays()
+	defer release()
+
+	n := 0
+	for _, ws := range relays {
+
+		if !ws.Writable() {
+			continue
+		}
+
+		n++
+
+		go func(ws *Connection) {
+
+			res := PublishResult{Relay: ws.Url()}
+
+			ack, err := ws.Publish(ctx, event)
+
+			switch {
+			case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+				res.Status = PublishTimeout
+				res.Message = err.Error()
+			case err != nil:
+				res.Status = PublishFailed
+				res.Message = err.Error()
+			case ack.Accepted:
+				res.Status = PublishAccepted
+				res.Message = ack.Message
+			default:
+				res.Status = PublishRejected
+				res.Message = ack.Message
+			}
+
+			results <- res
+		}(ws)
+	}
+
+	report := []PublishResult{}
+	for i := 0; i < n; i++ {
+		report = append(report, <-results)
+	}
+
+	return &event, report, nil
+}
+
+// Which relays answered a query.
+type RelayReport struct {
+
+	// Relays that sent EOSE before the deadline.
+	Answered []string
+
+	// Relays dropped because the deadline passed or the caller went away.
+	TimedOut []string
+}
+
+// Merged outcome of a query sent to every relay.
+type QueryResult struct {
+
+	// Unique events in the order they arrived.
+	Events []*nostr.Event
+
+	RelayReport
+}
+
+// Lower the filter limit to what the relay advertises in NIP-11.
+func clamp(ws *Connection, f nostr.Filter) nostr.Filter {
+
+	max := ws.MaxLimit()
+
+	if max > 0 && (f.Limit == 0 || f.Limit > max) {
+		f.Limit = max
+	}
+
+	return f
+}
+
+// First optional NIP the filter relies on that the relay does not advertise.
+func unsupported(ws *Connection, f nostr.Filter) (int, bool) {
+
+	// NIP-50 search, other relays would ignore the field and return everything.
+	if f.Search != "" && !ws.Supports(50) {
+		return 50, true
+	}
+
+	return 0, false
+}
+
+// Relays the filter can be sent to. Relays that are down and still
+// reconnecting, and those that do not advertise the features the filter
+// uses, are logged and left out.
+func usable(relays []*Connection, f nostr.Filter) []*Connection {
+
+	ok := []*Connection{}
+
+	for _, ws := range relays {
+
+		if !ws.Healthy() {
+			log.Printf("relay %s: unhealthy, skipping", ws.Url())
+			continue
+		}
+
+		if nip, missing := unsupported(ws, f); missing {
+			log.Printf("relay %s: does not support NIP-%02d, skipping", ws.Url(), nip)
+			continue
 		}
 
-		orDone := func(done <-chan struct{}, stream <-chan *nostr.Event) <-chan *nostr.Event {
-			valStream := make(chan *nostr.Event)
-			go func() {
-				defer close(valStream)
-				for {
+		ok = append(ok, ws)
+	}
+
+	return ok
+}
+
+// Message passed from a relay goroutine to the merging loop in fanOut.
+type relayMessage struct {
+	relay   string
+	event   *nostr.Event
+	eose    bool
+	timeout bool
+}
+
+// Send the filter to all healthy relays at the same time and merge the
+// results as they arrive, deduplicated by event id. Relays that have not
+// sent EOSE when the query deadline passes, or when ctx is cancelled, are
+// dropped and their subscriptions closed.
+func (s *Repository) fanOut(ctx context.Context, relays []*Connection, f nostr.Filter) *QueryResult {
+
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream := make(chan relayMessage)
+
+	var wg sync.WaitGroup
+
+	// Subscribe the filter to every open connection to a relay.
+	for _, ws := range usable(relays, f) {
+
+		wg.Add(1)
+
+		go func(ws *Connection) {
+			defer wg.Done()
+
+			sub, err := ws.Subscribe(nostr.Filters{clamp(ws, f)})
+			if err != nil {
+				log.Printf("relay %s: unable to subscribe: %v", ws.Url(), err)
+				return
+			}
+
+			// Sends CLOSE, also when the deadline passed or the client disconnected.
+			defer sub.Close()
+
+			for {
+				select {
+				case <-ctx.Done():
+					log.Printf("relay %s: no EOSE before query ended (%v), dropped", ws.Url(), ctx.Err())
+					stream <- relayMessage{relay: ws.Url(), timeout: true}
+					return
+				case e, ok := <-sub.EventStream:
+					if !ok {
+						log.Printf("relay %s: subscription closed: %s", ws.Url(), sub.Reason())
+						return
+					}
 					select {
-					case <-done:
+					case stream <- relayMessage{relay: ws.Url(), event: e}:
+					case <-ctx.Done():
 						return
-					case v, ok := <-stream:
-						if ok == false {
-							return
-						}
-						valStream <- v
 					}
+				case <-sub.Done:
+					stream <- relayMessage{relay: ws.Url(), eose: true}
+					return
 				}
-			}()
-			return valStream
+			}
+		}(ws)
+	}
+
+	// Close the stream once every relay has answered or been dropped.
+	go func() {
+		wg.Wait()
+		close(stream)
+	}()
+
+	res := &QueryResult{
+		Events: []*nostr.Event{},
+		RelayReport: RelayReport{
+			Answered: []string{},
+			TimedOut: []string{},
+		},
+	}
+
+	seen := make(map[string]struct{})
+
+	for m := range stream {
+
+		if m.eose {
+			res.Answered = append(res.Answered, m.relay)
+			continue
+		}
+
+		if m.timeout {
+			res.TimedOut = append(res.TimedOut, m.relay)
+			continue
 		}
 
-		for e := range orDone(sub.Done, sub.EventStream) {
-			events = append(events, e)
+		if _, ok := seen[m.event.Id]; ok {
+			continue
 		}
+		seen[m.event.Id] = struct{}{}
 
-		//cc.Close()
+		res.Events = append(res.Events, m.event)
 	}
 
-	return events, nil
+	return res
 }
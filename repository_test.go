@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+func TestFindArticles(t *testing.T) {
+
+	ctx := context.Background()
+
+	r := testRelay(t,
+		signedEvent(t, 0, `{"name":"alice"}`, 50),
+		signedEvent(t, 30023, "# One", 100, nostr.Tag{"d", "one"}, nostr.Tag{"title", "One"}),
+		signedEvent(t, 30023, "# Two", 200, nostr.Tag{"d", "two"}, nostr.Tag{"title", "Two"}),
+		signedEvent(t, 1, "not an article", 300),
+	)
+	s := testRepository(t, r)
+
+	pk, _ := nostr.GetPublicKey(testSk)
+	npub, _ := nostr.EncodePublicKey(pk)
+
+	profile, articles, report, err := s.FindArticles(ctx, npub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile.Name != "alice" {
+		t.Fatalf("profile %+v", profile)
+	}
+
+	if len(articles) != 2 {
+		t.Fatalf("got %d articles, want 2", len(articles))
+	}
+
+	if len(report.Answered) != 1 || len(report.TimedOut) != 0 {
+		t.Fatalf("report %+v", report)
+	}
+
+	// Served from the cache, the relays are not asked again.
+	_, articles, report, err = s.FindArticles(ctx, npub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(articles) != 2 || len(report.Answered) != 0 {
+		t.Fatalf("got %d articles and %+v, want 2 from the cache", len(articles), report)
+	}
+}
+
+func TestFindArticlesFromHint(t *testing.T) {
+
+	configured := testRelay(t)
+	hinted := testRelay(t, signedEvent(t, 30023, "# One", 100, nostr.Tag{"d", "one"}))
+
+	s := testRepository(t, configured)
+
+	pk, _ := nostr.GetPublicKey(testSk)
+	npub, _ := nostr.EncodePublicKey(pk)
+
+	profile, articles, _, err := s.FindArticles(context.Background(), npub, hinted.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(articles) != 1 {
+		t.Fatalf("got %d articles, want 1 from the hinted relay", len(articles))
+	}
+
+	// No kind 0 on any relay, the author is left blank.
+	if profile.PubKey != npub || profile.Name != "" {
+		t.Fatalf("profile %+v, want blank", profile)
+	}
+}
+
+func TestFindArticlesInvalid(t *testing.T) {
+
+	s := testRepository(t, testRelay(t))
+
+	pk, _ := nostr.GetPublicKey(testSk)
+	note, _ := nostr.EncodeNote(pk)
+
+	for _, npub := range []string{"npub1garbage", note} {
+		_, _, _, err := s.FindArticles(context.Background(), npub)
+		if !errors.Is(err, ErrInvalidEntity) {
+			t.Errorf("%s: got %v, want ErrInvalidEntity", npub, err)
+		}
+	}
+}
+
+func TestFindEvent(t *testing.T) {
+
+	ctx := context.Background()
+
+	note := signedEvent(t, 1, "note", 100)
+
+	s := testRepository(t, testRelay(t, note))
+
+	wrong := []*Entity{
+		{Prefix: "nevent", Id: note.Id, PubKey: signed.PubKey},
+		{Prefix: "nevent", Id: note.Id, Kind: 7, HasKind: true},
+		{Prefix: "nevent", Id: note.Id, Kind: 0, HasKind: true},
+	}
+
+	// Relayed and then cached, the event must be the one the entity names.
+	for i := 0; i < 2; i++ {
+		for _, entity := range wrong {
+			_, err := s.FindEvent(ctx, entity)
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("%+v: got %v, want ErrNotFound", entity, err)
+			}
+		}
+
+		e, err := s.FindEvent(ctx, &Entity{Prefix: "nevent", Id: note.Id, PubKey: note.PubKey, Kind: 1, HasKind: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Id != note.Id {
+			t.Fatalf("got event %s, want %s", e.Id, note.Id)
+		}
+	}
+}
+
+func TestArticleStaleWhileRevalidate(t *testing.T) {
+
+	ctx := context.Background()
+
+	pk, _ := nostr.GetPublicKey(testSk)
+	naddr, _ := EncodeAddress(pk, nostr.KindArticle, "golang")
+
+	r := testRelay(t, signedEvent(t, 30023, "# V1", 100, nostr.Tag{"d", "golang"}))
+
+	s := testRepository(t, r)
+	s.revalidating = newRevalidator()
+
+	// Nothing cached, fetched before returning.
+	a, err := s.Article(ctx, naddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.MdContent != "# V1" {
+		t.Fatalf("got %q, want the first version", a.MdContent)
+	}
+
+	r.Seed(signedEvent(t, 30023, "# V2", 200, nostr.Tag{"d", "golang"}))
+
+	// Fresh, the relay is not asked.
+	s.Article(ctx, naddr)
+	s.revalidating.wait()
+
+	a, err = s.Article(ctx, naddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.MdContent != "# V1" {
+		t.Fatalf("got %q, want the cached version within the TTL", a.MdContent)
+	}
+
+	// Stale, served as is and refreshed in the background.
+	s.ttl = time.Nanosecond
+
+	a, err = s.Article(ctx, naddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.MdContent != "# V1" {
+		t.Fatalf("got %q, want the stale version served right away", a.MdContent)
+	}
+
+	s.revalidating.wait()
+
+	a, err = s.Article(ctx, naddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.MdContent != "# V2" {
+		t.Fatalf("got %q, want the version refreshed in the background", a.MdContent)
+	}
+}
+
+func TestStoreProfile(t *testing.T) {
+
+	ctx := context.Background()
+
+	s := testRepository(t)
+
+	tests := []struct {
+		name  string
+		event nostr.Event
+		want  string
+	}{
+		{"first", signedEvent(t, 0, `{"name":"alice"}`, 100), "alice"},
+		{"newer that does not parse", signedEvent(t, 0, `{"name":`, 200), "alice"},
+		{"older arriving late", signedEvent(t, 0, `{"name":"old alice"}`, 50), "alice"},
+		{"newest", signedEvent(t, 0, `{"name":"bob"}`, 300), "bob"},
+	}
+
+	for _, tt := range tests {
+
+		profile, err := s.db.StoreProfile(ctx, &tt.event)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if profile.Name != tt.want {
+			t.Fatalf("%s: name %q, want %q", tt.name, profile.Name, tt.want)
+		}
+	}
+
+	// Nothing to fall back to, the event goes with the failed profile.
+	s = testRepository(t)
+
+	broken := signedEvent(t, 0, `not json`, 100)
+
+	_, err := s.db.StoreProfile(ctx, &broken)
+	if err == nil {
+		t.Fatal("profile stored from metadata that does not parse")
+	}
+
+	if _, err := s.db.queryEvent(ctx, broken.Id); err == nil {
+		t.Fatal("event kept after the profile failed")
+	}
+}
+
+func TestCategorizedPeople(t *testing.T) {
+
+	ctx := context.Background()
+
+	pk, _ := nostr.GetPublicKey(testSk)
+
+	list := signedEvent(t, 3000, "", 100, nostr.Tag{"d", "friends"}, nostr.Tag{"p", pk})
+	note := signedEvent(t, 1, "not a list", 200)
+
+	r := testRelay(t)
+	hinted := testRelay(t, list, note)
+
+	s := testRepository(t, r)
+
+	e, err := s.CategorizedPeople(ctx, &Entity{Prefix: "nevent", Id: list.Id, Relays: []string{hinted.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Id != list.Id || len(e.Tags) != 2 {
+		t.Fatalf("got %+v, want the list", e)
+	}
+
+	// Cached by the first lookup.
+	_, err = s.CategorizedPeople(ctx, &Entity{Prefix: "note", Id: list.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.CategorizedPeople(ctx, &Entity{Prefix: "nevent", Id: note.Id, Relays: []string{hinted.URL}})
+	if !errors.Is(err, ErrNotList) {
+		t.Fatalf("got %v, want ErrNotList", err)
+	}
+
+	_, err = s.CategorizedPeople(ctx, &Entity{Prefix: "note", Id: signedEvent(t, 3000, "", 300).Id})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestSearchSnippetMarkers(t *testing.T) {
+
+	ctx := context.Background()
+
+	s := testRepository(t)
+	if !s.db.fts {
+		t.Skip("built without FTS5")
+	}
+
+	// Markers in the article must not open or close a <mark> around markup.
+	e := signedEvent(t, 30023, "Goroutines \x03<script>alert(1)</script>\x02 and channels", 100, nostr.Tag{"d", "one"})
+
+	a, err := projectArticle(ctx, s.db.DB, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	npub, _ := nostr.EncodePublicKey(e.PubKey)
+
+	err = indexArticle(ctx, s.db.DB, a, npub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := s.db.SearchArticles(ctx, "channels", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(hits))
+	}
+
+	snippet := hits[0].Snippet
+
+	if strings.Contains(snippet, "<script>") || strings.Count(snippet, "<mark>") != 1 || strings.Count(snippet, "</mark>") != 1 {
+		t.Fatalf("snippet %q", snippet)
+	}
+}
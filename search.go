@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"strings"
+)
+
+var ErrNoFTS5 = errors.New("sqlite built without FTS5, build with -tags sqlite_fts5")
+
+// Cards returned for one search.
+const searchLimit = 50
+
+// Marks the matched terms in snippets. Control characters survive escaping
+// and are swapped for <mark> after, so they are stripped from whatever is
+// indexed, see unmarked.
+const (
+	markOpen  = "\x02"
+	markClose = "\x03"
+)
+
+// Drops the marker characters from indexed text.
+var markStripper = strings.NewReplacer(markOpen, "", markClose, "")
+
+// Text as indexed, without the characters snippets mark matches with.
+func unmarked(s string) string {
+	return markStripper.Replace(s)
+}
+
+// SQL expression of the column as indexed, see unmarked.
+func unmarkedSql(column string) string {
+	return "REPLACE(REPLACE(" + column + ", char(2), ''), char(3), '')"
+}
+
+// Article matching a search, best match first.
+type SearchHit struct {
+	Article *Article
+
+	// Excerpt around the matched terms as HTML, terms in <mark>.
+	Snippet string
+}
+
+// Create the article search index if missing and add the cached articles
+// it lacks, such as those stored by a build without FTS5.
+func createSearchIndex(ctx context.Context, q querier) error {
+
+	_, err := q.ExecContext(ctx, `
+    CREATE VIRTUAL TABLE IF NOT EXISTS article_search USING fts5 (
+        article_id UNINDEXED,
+        title,
+        summary,
+        content,
+        author,
+        tokenize = 'porter unicode61'
+    );`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return ErrNoFTS5
+		}
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, `
+    INSERT INTO article_search (article_id, title, summary, content, author)
+    SELECT a.article_id, `+unmarkedSql("IFNULL(a.title, '')")+`, `+unmarkedSql("IFNULL(a.summary, '')")+`,
+        `+unmarkedSql("IFNULL(a.md_content, '')")+`, `+unmarkedSql("IFNULL(p.name, '')")+`
+    FROM article a
+    LEFT JOIN article_profile ap ON ap.article_id = a.article_id
+    LEFT JOIN profile p ON p.pubkey = ap.pubkey
+    WHERE a.article_id NOT IN (SELECT article_id FROM article_search)
+    `)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Whether SQLite was built with FTS5, see the sqlite_fts5 build tag.
+func hasFTS5(ctx context.Context, db *sql.DB) bool {
+
+	var used bool
+
+	err := db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used)
+	if err != nil {
+		return false
+	}
+
+	return used
+}
+
+// Replace the article's row in the search index. The author column comes
+// from the cached profile, StoreProfile updates it once one arrives.
+func indexArticle(ctx context.Context, q querier, a *Article, npub string) error {
+
+	_, err := q.ExecContext(ctx, "DELETE FROM article_search WHERE article_id = ?", a.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, `
+    INSERT INTO article_search (article_id, title, summary, content, author)
+    VALUES (?, ?, ?, ?, `+unmarkedSql("IFNULL((SELECT name FROM profile WHERE pubkey = ?), '')")+`)
+    `, a.Id, unmarked(a.Title), unmarked(a.Summary), unmarked(a.MdContent), npub)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Full-text search over title, summary, markdown and author name of the
+// cached articles, ranked by bm25 with title matches counting most.
+func (s *Db) SearchArticles(ctx context.Context, query string, limit int) ([]*SearchHit, error) {
+
+	if !s.fts {
+		return nil, ErrNoFTS5
+	}
+
+	match := ftsQuery(query)
+	if match == "" {
+		return []*SearchHit{}, nil
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `
+        SELECT a.article_id, a.image, a.title, a.summary, a.md_content, a.html_content, a.published_at,
+            snippet(article_search, -1, ?, ?, '…', 32)
+        FROM article_search
+        JOIN article a ON a.article_id = article_search.article_id
+        WHERE article_search MATCH ?
+        ORDER BY bm25(article_search, 0.0, 10.0, 5.0, 1.0, 2.0)
+        LIMIT ?
+    `, markOpen, markClose, match, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []*SearchHit{}
+
+	for rows.Next() {
+
+		var a Article
+		var snippet string
+
+		err := rows.Scan(&a.Id, &a.Image, &a.Title, &a.Summary, &a.MdContent, &a.HtmlContent, &a.PublishedAt, &snippet)
+		if err != nil {
+			return nil, err
+		}
+
+		hits = append(hits, &SearchHit{
+			Article: &a,
+			Snippet: highlight(snippet),
+		})
+	}
+
+	return hits, rows.Err()
+}
+
+// Quote every word of the user's query, so operators and stray quotes are
+// searched for as text instead of failing as FTS5 syntax. Words are
+// matched as prefixes and all of them must appear.
+func ftsQuery(query string) string {
+
+	terms := []string{}
+
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// Escape the snippet, then turn the match markers into <mark>.
+func highlight(snippet string) string {
+
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, markOpen, "<mark>")
+	snippet = strings.ReplaceAll(snippet, markClose, "</mark>")
+
+	return snippet
+}
+
+// Point the author column of the author's articles at the current name.
+func reindexAuthor(ctx context.Context, q querier, npub, name string) error {
+
+	_, err := q.ExecContext(ctx, `
+    UPDATE article_search SET author = ?
+    WHERE article_id IN (SELECT article_id FROM article_profile WHERE pubkey = ?)
+    `, unmarked(name), npub)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
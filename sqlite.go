@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"time"
 
+	"github.com/dextryz/ixian/negentropy"
 	"github.com/dextryz/nostr"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -25,13 +26,19 @@ type Profile struct {
 	Banner     string
 	Picture    string
 	Identifier string
+
+	// Creation date of the kind 0 the profile was taken from.
+	UpdatedAt string
+
+	// When the profile was last pulled from the relays.
+	RefreshedAt string
 }
 
 // We want the client to have its own domain language to make
 // it explicit what is supported and what is not. We are flattening a general NIP-23 event.
 // Store both content for reference. Also makes it more explicit. Principle of Explicivity
 type Article struct {
-	Id          string // NIP-19 (note1...)
+	Id          string // NIP-19 address (naddr1...)
 	Image       string
 	Title       string
 	Summary     string
@@ -47,112 +54,171 @@ type Db struct {
 	QueryIdLimit     int
 	QueryAuthorLimit int
 	QueryTagLimit    int
+
+	// SQLite has FTS5, without it articles are not indexed for search.
+	fts bool
 }
 
-func (s *Db) Close() {
-	s.DB.Close()
+func (s *Db) Close() error {
+	return s.DB.Close()
 }
 
-func createTables(db *sql.DB) error {
-
-	createArticleSQL := `
-    CREATE TABLE IF NOT EXISTS article (
-        article_id TEXT PRIMARY KEY,
-        image TEXT,
-        title TEXT,
-        summary TEXT,
-        md_content TEXT,
-        html_content TEXT,
-        published_at INTEGER
-    );`
-
-	createTagSQL := `
-    CREATE TABLE IF NOT EXISTS hashtag (
-        hashtag_name TEXT PRIMARY KEY
-    );`
-
-	createArticleHashtagSQL := `
-    CREATE TABLE IF NOT EXISTS article_hashtag (
-        article_id TEXT,
-        hashtag_name TEXT,
-        FOREIGN KEY (article_id) REFERENCES article (article_id),
-        FOREIGN KEY (hashtag_name) REFERENCES hashtag (hashtag_name),
-        PRIMARY KEY (article_id, hashtag_name)
-    );`
-
-	createProfileSQL := `
-    CREATE TABLE IF NOT EXISTS profile (
-        pubkey TEXT PRIMARY KEY,
-        name TEXT,
-        about TEXT,
-        website TEXT,
-        banner TEXT,
-        picture TEXT,
-        identifier TEXT
-    );`
-
-	createArticleProfileSQL := `
-    CREATE TABLE IF NOT EXISTS article_profile (
-        article_id TEXT,
-        pubkey TEXT,
-        FOREIGN KEY (article_id) REFERENCES article (article_id),
-        FOREIGN KEY (pubkey) REFERENCES profile (pubkey),
-        PRIMARY KEY (article_id, pubkey)
-    )
-    `
+// Open the cache and bring its schema up to date, see migrate.
+func NewSqlite(database string) *Db {
 
-	_, err := db.Exec(createProfileSQL)
+	db, err := sql.Open("sqlite3", database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	err = migrate(ctx, db, database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &Db{
+		DB:               db,
+		QueryLimit:       500,
+		QueryIdLimit:     10,
+		QueryAuthorLimit: 10,
+		QueryTagLimit:    10,
+		fts:              hasFTS5(ctx, db),
+	}
+
+	if s.fts {
+		err = createSearchIndex(ctx, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Printf("article search disabled: %v", ErrNoFTS5)
+	}
+
+	return s
+}
+
+// Keep the signed event as is, with the columns it is looked up by.
+func (s *Db) StoreEvent(ctx context.Context, e *nostr.Event) error {
+
+	// The event and its tags are written together, filters never see one
+	// without the other.
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec(createArticleProfileSQL)
+	err = insertEvent(ctx, tx, e)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(createArticleSQL)
+	return tx.Commit()
+}
+
+// Write the event row and its tags.
+func insertEvent(ctx context.Context, q querier, e *nostr.Event) error {
+
+	// Connections verify events on receipt, checked again here so nothing
+	// unverified reaches the cache whatever the path.
+	err := Verify(e)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(createTagSQL)
+	raw, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(createArticleHashtagSQL)
+	// Parameterized replaceable events are addressed by their d tag, a
+	// missing one counts as empty.
+	var d sql.NullString
+	if isParameterized(e.Kind) {
+		d = sql.NullString{String: identifier(e), Valid: true}
+	}
+
+	eventSql := "INSERT OR IGNORE INTO event (id, pubkey, kind, created_at, d_tag, raw) VALUES (?, ?, ?, ?, ?, ?)"
+
+	_, err = q.ExecContext(ctx, eventSql, e.Id, e.PubKey, e.Kind, int64(e.CreatedAt), d, string(raw))
 	if err != nil {
 		return err
 	}
 
-	log.Println("table events created")
+	return insertTags(ctx, q, e)
+}
+
+// Index the single letter tags of the event, the ones NIP-01 filters can
+// match with #<letter>.
+func insertTags(ctx context.Context, q querier, e *nostr.Event) error {
+
+	for _, t := range e.Tags {
+
+		if len(t) < 2 || len(t[0]) != 1 {
+			continue
+		}
+
+		_, err := q.ExecContext(ctx, "INSERT OR IGNORE INTO event_tag (event_id, name, value) VALUES (?, ?, ?)", e.Id, t[0], t[1])
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func NewSqlite(database string) *Db {
+// Store the kind 0 event and project the newest one stored for the author
+// onto the profile table, whatever order they arrive in.
+func (s *Db) StoreProfile(ctx context.Context, e *nostr.Event) (*Profile, error) {
 
-	db, err := sql.Open("sqlite3", database)
+	// The event, the profile row and the search index change together, a
+	// failure in between leaves none of them behind.
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	err = createTables(db)
+	err = insertEvent(ctx, tx, e)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return &Db{
-		DB:               db,
-		QueryLimit:       500,
-		QueryIdLimit:     10,
-		QueryAuthorLimit: 10,
-		QueryTagLimit:    10,
+	// An older kind 0 arrived late, the newest one stays current. Metadata
+	// that does not parse is passed over for the version before it.
+	versions, err := scanEvents(ctx, tx, `
+        SELECT raw FROM event
+        WHERE pubkey = ? AND kind = ?
+        ORDER BY created_at DESC, id ASC
+    `, e.PubKey, e.Kind)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (s *Db) StoreProfile(ctx context.Context, p *nostr.Profile, npub string) (*Profile, error) {
+	err = sql.ErrNoRows
+	for _, v := range versions {
+		_, err = nostr.ParseMetadata(*v)
+		if err == nil {
+			e = v
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := nostr.ParseMetadata(*e)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode NIP-01 pubkey to NIP-19 npub
+	npub, err := nostr.EncodePublicKey(e.PubKey)
+	if err != nil {
+		return nil, err
+	}
 
 	profile := &Profile{
 		PubKey:     npub,
@@ -164,7 +230,25 @@ func (s *Db) StoreProfile(ctx context.Context, p *nostr.Profile, npub string) (*
 		Identifier: p.Nip05,
 	}
 
-	err := s.insertProfile(ctx, profile)
+	err = upsertProfile(ctx, tx, profile, int64(e.CreatedAt))
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err = scanProfile(tx.QueryRowContext(ctx, `SELECT `+profileColumns+` FROM `+profileFrom+` WHERE p.pubkey = ?`, npub))
+	if err != nil {
+		return nil, err
+	}
+
+	// Articles stay findable by the author's current name.
+	if s.fts {
+		err = reindexAuthor(ctx, tx, npub, profile.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
@@ -172,10 +256,83 @@ func (s *Db) StoreProfile(ctx context.Context, p *nostr.Profile, npub string) (*
 	return profile, nil
 }
 
+// Kinds 30000 to 39999 are replaced by newer events with the same d tag.
+func isParameterized(kind uint32) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// Value of the d tag, empty if there is none.
+func identifier(e *nostr.Event) string {
+	for _, t := range e.Tags {
+		if t.Key() == "d" {
+			return t.Value()
+		}
+	}
+	return ""
+}
+
 // THis funtion is responsible for data convertion.
 // Has to convert data from nostr DL to db DL.
+// The raw event is stored as well, the article row is its projection.
+// Articles are keyed by their naddr address and the row always holds the
+// newest version, whatever order the versions arrive in.
 func (s *Db) StoreArticle(ctx context.Context, e *nostr.Event) (*Article, error) {
 
+	// The event, its projection and the search index change together, a
+	// failure in between leaves none of them behind.
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = insertEvent(ctx, tx, e)
+	if err != nil {
+		return nil, err
+	}
+
+	// An older version arrived late, the newest one stays current.
+	e, err = newestEvent(ctx, tx, e.PubKey, e.Kind, identifier(e))
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := projectArticle(ctx, tx, e)
+	if err != nil {
+		return nil, err
+	}
+
+	npub, err := nostr.EncodePublicKey(e.PubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.fts {
+		err = indexArticle(ctx, tx, a, npub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Event (id: %s) stored in repository DB", e.Id)
+
+	return a, nil
+}
+
+// Statements that run the same on the database and inside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Write the article row, hashtags and author of the version of an article.
+func projectArticle(ctx context.Context, q querier, e *nostr.Event) (*Article, error) {
+
 	// Sample Unix timestamp: 1635619200 (represents 2021-10-30)
 	unixTimestamp := int64(e.CreatedAt)
 
@@ -185,8 +342,8 @@ func (s *Db) StoreArticle(ctx context.Context, e *nostr.Event) (*Article, error)
 	// Format time.Time to "yyyy-mm-dd"
 	createdAt := t.Format("2006-01-02")
 
-	// Encode NIP-01 event id to NIP-19 note id
-	id, err := nostr.EncodeNote(e.Id)
+	// Encode the NIP-01 address to a NIP-19 naddr, the same for every version.
+	id, err := EncodeAddress(e.PubKey, e.Kind, identifier(e))
 	if err != nil {
 		return nil, err
 	}
@@ -220,38 +377,50 @@ func (s *Db) StoreArticle(ctx context.Context, e *nostr.Event) (*Article, error)
 		}
 	}
 
-	err = s.insertArticle(ctx, a)
+	err = upsertArticle(ctx, q, a)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tags of the previous version no longer apply.
+	_, err = q.ExecContext(ctx, "DELETE FROM article_hashtag WHERE article_id = ?", a.Id)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, tag := range a.HashTags {
-		err = s.insertAndAssociateTag(ctx, a.Id, tag)
+		err = insertAndAssociateTag(ctx, q, a.Id, tag)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = s.associateProfile(ctx, a.Id, npub)
+	err = associateProfile(ctx, q, a.Id, npub)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Event (id: %s) stored in repository DB", e.Id)
-
 	return a, nil
 }
 
-func (s *Db) insertProfile(ctx context.Context, p *Profile) error {
-
-	eventSql := "INSERT OR IGNORE INTO profile (pubkey, name, about, website, banner, picture, identifier) VALUES ($1, $2, $3, $4, $5, $6, $7)"
-
-	res, err := s.DB.ExecContext(ctx, eventSql, p.PubKey, p.Name, p.About, p.Website, p.Banner, p.Picture, p.Identifier)
-	if err != nil {
-		return err
-	}
+// Insert the profile or replace it with metadata from a newer kind 0.
+func upsertProfile(ctx context.Context, q querier, p *Profile, createdAt int64) error {
+
+	eventSql := `
+    INSERT INTO profile (pubkey, name, about, website, banner, picture, identifier, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    ON CONFLICT (pubkey) DO UPDATE SET
+        name = excluded.name,
+        about = excluded.about,
+        website = excluded.website,
+        banner = excluded.banner,
+        picture = excluded.picture,
+        identifier = excluded.identifier,
+        created_at = excluded.created_at
+    WHERE excluded.created_at >= profile.created_at
+    `
 
-	_, err = res.RowsAffected()
+	_, err := q.ExecContext(ctx, eventSql, p.PubKey, p.Name, p.About, p.Website, p.Banner, p.Picture, p.Identifier, createdAt)
 	if err != nil {
 		return err
 	}
@@ -259,16 +428,22 @@ func (s *Db) insertProfile(ctx context.Context, p *Profile) error {
 	return nil
 }
 
-func (s *Db) insertArticle(ctx context.Context, a *Article) error {
-
-	eventSql := "INSERT OR IGNORE INTO article (article_id, image, title, summary, md_content, html_content, published_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
-
-	res, err := s.DB.ExecContext(ctx, eventSql, a.Id, a.Image, a.Title, a.Summary, a.MdContent, a.HtmlContent, a.PublishedAt)
-	if err != nil {
-		return err
-	}
+// Insert the article or replace the previous version at the same address.
+func upsertArticle(ctx context.Context, q querier, a *Article) error {
+
+	eventSql := `
+    INSERT INTO article (article_id, image, title, summary, md_content, html_content, published_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (article_id) DO UPDATE SET
+        image = excluded.image,
+        title = excluded.title,
+        summary = excluded.summary,
+        md_content = excluded.md_content,
+        html_content = excluded.html_content,
+        published_at = excluded.published_at
+    `
 
-	_, err = res.RowsAffected()
+	_, err := q.ExecContext(ctx, eventSql, a.Id, a.Image, a.Title, a.Summary, a.MdContent, a.HtmlContent, a.PublishedAt)
 	if err != nil {
 		return err
 	}
@@ -276,10 +451,10 @@ func (s *Db) insertArticle(ctx context.Context, a *Article) error {
 	return nil
 }
 
-func (s *Db) associateProfile(ctx context.Context, noteId string, pubkey string) error {
+func associateProfile(ctx context.Context, q querier, noteId string, pubkey string) error {
 
 	// Associate profile with article
-	_, err := s.DB.ExecContext(ctx, "INSERT OR IGNORE INTO article_profile (article_id, pubkey) VALUES (?, ?)", noteId, pubkey)
+	_, err := q.ExecContext(ctx, "INSERT OR IGNORE INTO article_profile (article_id, pubkey) VALUES (?, ?)", noteId, pubkey)
 	if err != nil {
 		return err
 	}
@@ -288,16 +463,16 @@ func (s *Db) associateProfile(ctx context.Context, noteId string, pubkey string)
 }
 
 // TODO: Why do I need to pass the context?
-func (s *Db) insertAndAssociateTag(ctx context.Context, noteId string, tagName string) error {
+func insertAndAssociateTag(ctx context.Context, q querier, noteId string, tagName string) error {
 
 	// Insert tag (ignore if already exists)
-	_, err := s.DB.ExecContext(ctx, "INSERT OR IGNORE INTO hashtag (hashtag_name) VALUES (?)", tagName)
+	_, err := q.ExecContext(ctx, "INSERT OR IGNORE INTO hashtag (hashtag_name) VALUES (?)", tagName)
 	if err != nil {
 		return err
 	}
 
 	// Associate tag with note
-	_, err = s.DB.ExecContext(ctx, "INSERT OR IGNORE INTO article_hashtag (article_id, hashtag_name) VALUES (?, ?)", noteId, tagName)
+	_, err = q.ExecContext(ctx, "INSERT OR IGNORE INTO article_hashtag (article_id, hashtag_name) VALUES (?, ?)", noteId, tagName)
 	if err != nil {
 		return err
 	}
@@ -305,132 +480,145 @@ func (s *Db) insertAndAssociateTag(ctx context.Context, noteId string, tagName s
 	return nil
 }
 
-func (s *Db) QueryArticles(ctx context.Context, filter nostr.Filter) ([]*Article, error) {
+// The refresh time comes from the profile's freshness entry.
+const profileColumns = "p.pubkey, p.name, p.about, p.website, p.banner, p.picture, p.identifier, p.created_at, IFNULL(f.refreshed_at, 0)"
 
-	articles := []*Article{}
+const profileFrom = "profile p LEFT JOIN freshness f ON f.entity = 'profile:' || p.pubkey"
 
-	// 1. Search by IDs
+func scanProfile(row *sql.Row) (*Profile, error) {
 
-	if filter.Ids != nil {
-		if len(filter.Ids) > s.QueryIdLimit {
-			return nil, fmt.Errorf("requested articles exceeds ID limit of %d", s.QueryIdLimit)
-		}
-	}
-
-	// 2. Search by PubKeys
+	var p Profile
+	var createdAt, refreshedAt int64
 
-	if filter.Authors != nil {
-		if len(filter.Ids) > s.QueryAuthorLimit {
-			return nil, fmt.Errorf("authors exceeds limit of %d", s.QueryAuthorLimit)
-		}
+	err := row.Scan(&p.PubKey, &p.Name, &p.About, &p.Website, &p.Banner, &p.Picture, &p.Identifier, &createdAt, &refreshedAt)
+	if err != nil {
+		return nil, err
+	}
 
+	// Zero for profiles cached before updates were tracked.
+	if createdAt > 0 {
+		p.UpdatedAt = time.Unix(createdAt, 0).Format("2006-01-02")
+	}
+	if refreshedAt > 0 {
+		p.RefreshedAt = time.Unix(refreshedAt, 0).Format("2006-01-02 15:04")
 	}
 
-	// 3. Search by Tags
+	return &p, nil
+}
 
-	for _, tags := range filter.Tags {
-		if len(tags) > s.QueryTagLimit {
-			return nil, fmt.Errorf("tags exceeds limit of %d", s.QueryTagLimit)
-		}
-	}
+func (s *Db) queryProfileByPubkey(ctx context.Context, pubkey string) (*Profile, error) {
 
-	// 4. Search by Content
+	row := s.DB.QueryRowContext(ctx, `SELECT `+profileColumns+` FROM `+profileFrom+` WHERE p.pubkey = ?`, pubkey)
 
-	return articles, nil
+	return scanProfile(row)
 }
 
-func (s *Db) queryProfileByPubkey(pubkey string) (*Profile, error) {
-
-	rows := s.DB.QueryRow(`SELECT * FROM profile WHERE pubkey = ?`, pubkey)
+// Event ids and timestamps of the author's cached articles, by hex pubkey.
+func (s *Db) queryArticleItems(ctx context.Context, pk string) ([]negentropy.Item, error) {
 
-	var p Profile
-	err := rows.Scan(&p.PubKey, &p.Name, &p.About, &p.Website, &p.Banner, &p.Picture, &p.Identifier)
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, created_at FROM event WHERE pubkey = ? AND kind = ?`, pk, nostr.KindArticle)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &p, nil
-}
-
-func (s *Db) queryArticleById(nid string) (*Article, error) {
+	items := []negentropy.Item{}
+	for rows.Next() {
+		var id string
+		var createdAt int64
+		err := rows.Scan(&id, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		item, err := negentropy.NewItem(createdAt, id)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
 
-	rows := s.DB.QueryRow(`SELECT * FROM article WHERE article_id = ?`, nid)
+	return items, rows.Err()
+}
 
-	var a Article
-	err := rows.Scan(&a.Id, &a.Image, &a.Title, &a.Summary, &a.MdContent, &a.HtmlContent, &a.PublishedAt)
+// Current version of a replaceable event: the newest, and of those created
+// at the same second the one with the lowest id. Kinds that are not
+// parameterized have no d tag, pass an empty one.
+func newestEvent(ctx context.Context, q querier, pubkey string, kind uint32, d string) (*nostr.Event, error) {
+
+	events, err := scanEvents(ctx, q, `
+        SELECT raw FROM event
+        WHERE pubkey = ? AND kind = ? AND IFNULL(d_tag, '') = ?
+        ORDER BY created_at DESC, id ASC
+        LIMIT 1
+    `, pubkey, kind, d)
 	if err != nil {
 		return nil, err
 	}
 
-	return &a, nil
+	if len(events) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return events[0], nil
 }
 
-func (s *Db) queryArticleByTag(tag string) ([]*Article, error) {
+// Every stored version of a parameterized replaceable event, newest first.
+func (s *Db) queryVersions(ctx context.Context, pubkey string, kind uint32, d string) ([]*nostr.Event, error) {
 
-	rows, err := s.DB.Query(`
-        SELECT n.* FROM article n
-        JOIN article_hashtag nt ON n.article_id = nt.article_id
-        JOIN hashtag t ON nt.hashtag_name = t.hashtag_name
-        WHERE t.hashtag_name = ?
-    `, tag)
+	rows, err := s.DB.QueryContext(ctx, `
+        SELECT raw FROM event
+        WHERE pubkey = ? AND kind = ? AND d_tag = ?
+        ORDER BY created_at DESC, id ASC
+    `, pubkey, kind, d)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	articles := []*Article{}
+	events := []*nostr.Event{}
 	for rows.Next() {
-		var a Article
-		err := rows.Scan(&a.Id, &a.Image, &a.Title, &a.Summary, &a.MdContent, &a.HtmlContent, &a.PublishedAt)
+		var raw string
+		err := rows.Scan(&raw)
+		if err != nil {
+			return nil, err
+		}
+		var e nostr.Event
+		err = json.Unmarshal([]byte(raw), &e)
 		if err != nil {
 			return nil, err
 		}
-		articles = append(articles, &a)
+		events = append(events, &e)
 	}
 
-	return articles, nil
+	return events, rows.Err()
 }
 
-func (s *Db) queryArticleByProfile(pubkey string) error {
+// Signed event as received from the relay, by hex id.
+func (s *Db) queryEvent(ctx context.Context, id string) (*nostr.Event, error) {
 
-	rows, err := s.DB.Query(`
-        SELECT n.* FROM article n
-        JOIN article_profile nt ON n.article_id = nt.article_id
-        JOIN profile t ON nt.pubkey = t.pubkey
-        WHERE t.pubkey = ?
-    `, pubkey)
+	row := s.DB.QueryRowContext(ctx, `SELECT raw FROM event WHERE id = ?`, id)
+
+	var raw string
+	err := row.Scan(&raw)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var a Article
-		err := rows.Scan(&a.Id, &a.Image, &a.Title, &a.Summary, &a.MdContent, &a.HtmlContent, &a.PublishedAt)
-		if err != nil {
-			return err
-		}
-		log.Println("Found article by profile:", a)
+	var e nostr.Event
+	err = json.Unmarshal([]byte(raw), &e)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return &e, nil
 }
 
-func (s *Db) queryProfileByArticle(id string) (*Profile, error) {
+func (s *Db) queryProfileByArticle(ctx context.Context, id string) (*Profile, error) {
 
-	rows := s.DB.QueryRow(`
-        SELECT n.* FROM profile n
-        JOIN article_profile nt ON n.pubkey = nt.pubkey
-        JOIN article t ON nt.article_id = t.article_id
-        WHERE t.article_id = ?
+	row := s.DB.QueryRowContext(ctx, `
+        SELECT `+profileColumns+` FROM `+profileFrom+`
+        WHERE p.pubkey = (SELECT pubkey FROM article_profile WHERE article_id = ?)
     `, id)
 
-	var p Profile
-
-	err := rows.Scan(&p.PubKey, &p.Name, &p.About, &p.Website, &p.Banner, &p.Picture, &p.Identifier)
-	if err != nil {
-		return nil, err
-	}
-
-	return &p, nil
+	return scanProfile(row)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"strconv"
+	"sync"
 	"sync/atomic"
 
 	"github.com/dextryz/nostr"
@@ -9,16 +10,52 @@ import (
 
 var subId atomic.Int32
 
+// Messages a subscription can buffer before the subscriber is considered
+// abandoned. Large enough to hold a full QueryLimit page.
+const subscriptionBuffer = 1024
+
+// Event or EOSE queued by the socket reader for the subscriber.
+type subMessage struct {
+	event *nostr.Event
+	eose  bool
+}
+
 type Subscription struct {
 
 	// Keep track of total subscriptions
 	counter int
 
 	// Place events from read socket onto inmem channel.
+	// Closed once the subscription ends.
 	EventStream chan *nostr.Event
 
 	// Close subscription when EOSE event read from socket.
 	Done chan struct{}
+
+	// Filters of the last REQ, re-issued when the connection reconnects.
+	filters nostr.Filters
+
+	// Keeps delivering newly published events after EOSE, see SubscribeLive.
+	live bool
+
+	// Newest created_at delivered, so a live subscription resumes from
+	// there after a reconnect instead of replaying stored events.
+	newest atomic.Int64
+
+	// Connection that owns the subscription, used to send CLOSE.
+	conn *Connection
+
+	// Buffer between the socket reader and the subscriber, so the reader
+	// never blocks on a slow consumer.
+	queue chan subMessage
+
+	// Closed when the subscription ends, either by us or by the relay.
+	closed chan struct{}
+
+	once sync.Once
+
+	// Why the subscription ended, as sent by the relay in a CLOSED message.
+	reason string
 }
 
 func NewSubscription() *Subscription {
@@ -26,11 +63,17 @@ func NewSubscription() *Subscription {
 	// Increment the subscription counter.
 	counter := subId.Add(1)
 
-	return &Subscription{
+	sub := &Subscription{
 		counter:     int(counter),
 		EventStream: make(chan *nostr.Event),
 		Done:        make(chan struct{}),
+		queue:       make(chan subMessage, subscriptionBuffer),
+		closed:      make(chan struct{}),
 	}
+
+	go sub.pump()
+
+	return sub
 }
 
 func (s *Subscription) GetId() string {
@@ -46,17 +89,190 @@ func (s *Subscription) Fire(filters nostr.Filters, reqStream chan<- nostr.Messag
 	req.SubscriptionId = s.GetId()
 	req.Filters = filters
 
+	// Nobody reads the stream once the connection is closed.
+	var closed <-chan struct{}
+	if s.conn != nil {
+		closed = s.conn.done
+	}
+
 	// TODO: Why am I using Done here? Is it just to user a select>
 	select {
 	case reqStream <- req:
 	case <-s.Done:
 		return nil
+	case <-s.closed:
+		return nil
+	case <-closed:
+		return ErrConnectionClosed
 	}
 
 	return nil
 }
 
-// TODO: properly impl the close.
+// Queue a message for the subscriber without blocking the socket reader.
+// Returns false if the queue is full, meaning the subscriber stopped reading.
+func (s *Subscription) enqueue(m subMessage) bool {
+
+	select {
+	case <-s.closed:
+		return true
+	default:
+	}
+
+	if m.event != nil {
+		created := int64(m.event.CreatedAt)
+		if created > s.newest.Load() {
+			s.newest.Store(created)
+		}
+	}
+
+	select {
+	case s.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// Forward queued messages to EventStream and Done in the order they were
+// read from the socket. The pump is the only sender on EventStream, so it
+// closes it once the subscription ends.
+func (s *Subscription) pump() {
+
+	defer close(s.EventStream)
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case m := <-s.queue:
+
+			if m.eose {
+
+				// Live subscribers only read events, nobody waits on Done.
+				if s.live {
+					continue
+				}
+
+				select {
+				case s.Done <- struct{}{}:
+				case <-s.closed:
+					return
+				}
+				continue
+			}
+
+			select {
+			case s.EventStream <- m.event:
+			case <-s.closed:
+				return
+			}
+		}
+	}
+}
+
+// End the subscription locally. EventStream is closed by the pump.
+// Safe to call more than once and from any goroutine.
+func (s *Subscription) end(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		close(s.closed)
+	})
+}
+
+// Closed is closed when the subscription has ended.
+func (s *Subscription) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Reason the relay gave for ending the subscription, if any.
+// Only valid once Closed is closed.
+func (s *Subscription) Reason() string {
+	return s.reason
+}
+
+// Filters to re-issue after a reconnect. A live subscription asks only for
+// events from the newest one it has already seen.
+func (s *Subscription) resumeFilters() nostr.Filters {
+
+	newest := s.newest.Load()
+	if !s.live || newest == 0 {
+		return s.filters
+	}
+
+	since := nostr.Timestamp(newest)
+
+	filters := make(nostr.Filters, len(s.filters))
+	for i, f := range s.filters {
+		if f.Since == nil || *f.Since < since {
+			f.Since = &since
+		}
+		filters[i] = f
+	}
+
+	return filters
+}
+
+// Send a NIP-01 CLOSE to the relay and release the subscription.
 func (s *Subscription) Close() error {
+
+	if s.conn != nil {
+		s.conn.unsubscribe(s.GetId())
+	}
+
+	s.end("")
+
 	return nil
 }
+
+// Concurrency safe set of open subscriptions keyed by id. Written by
+// handler goroutines through Subscribe and Close, read by the socket reader.
+type registry struct {
+	mu   sync.RWMutex
+	subs map[string]*Subscription
+}
+
+func newRegistry() *registry {
+	return &registry{
+		subs: make(map[string]*Subscription),
+	}
+}
+
+func (s *registry) add(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub.GetId()] = sub
+}
+
+func (s *registry) get(id string) (*Subscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subs[id]
+	return sub, ok
+}
+
+// Remove the subscription and report whether it was still registered.
+func (s *registry) remove(id string) (*Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[id]
+	delete(s.subs, id)
+	return sub, ok
+}
+
+// Snapshot of the open subscriptions.
+func (s *registry) all() []*Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+func (s *registry) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.subs)
+}
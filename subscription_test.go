@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dextryz/nostr"
+)
+
+func TestSubscribeCloseWhileDispatching(t *testing.T) {
+
+	events := []nostr.Event{}
+	for i := 0; i < 20; i++ {
+		events = append(events, signedEvent(t, 1, "note", int64(100+i)))
+	}
+
+	r := testRelay(t, events...)
+	c := testConnection(t, r)
+
+	f := nostr.Filters{{Kinds: []uint32{1}}}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			sub, err := c.Subscribe(f)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			// Some close right away, while the reader dispatches to them.
+			if i%2 == 0 {
+				<-sub.EventStream
+			}
+
+			sub.Close()
+		}(i)
+	}
+
+	wg.Wait()
+
+	sub, err := c.Subscribe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	got := drain(t, sub)
+	if len(got) != len(events) {
+		t.Fatalf("got %d events, want %d", len(got), len(events))
+	}
+
+	sub.Close()
+
+	eventually(t, "subscriptions closed on the relay", func() bool {
+		return c.Subscriptions() == 0 && r.Subscriptions() == 0
+	})
+}
+
+func TestSlowSubscriberIsClosed(t *testing.T) {
+
+	// More than a subscription can buffer.
+	events := []nostr.Event{}
+	for i := 0; i < subscriptionBuffer+100; i++ {
+		events = append(events, signedEvent(t, 1, "note", int64(100+i)))
+	}
+
+	r := testRelay(t, events...)
+	c := testConnection(t, r)
+
+	f := nostr.Filters{{Kinds: []uint32{1}}}
+
+	slow, err := c.Subscribe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fast, err := c.Subscribe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := drain(t, fast)
+	if len(got) != len(events) {
+		t.Fatalf("got %d events, want %d", len(got), len(events))
+	}
+
+	<-slow.Closed()
+
+	if slow.Reason() != "slow consumer" {
+		t.Fatalf("reason %q, want slow consumer", slow.Reason())
+	}
+
+	eventually(t, "CLOSE sent for the slow subscription", func() bool {
+		return r.Subscriptions() == 1
+	})
+}
+
+func TestEventStreamClosedOnce(t *testing.T) {
+
+	r := testRelay(t, signedEvent(t, 1, "note", 100))
+	c := NewConnection(r.URL)
+
+	err := c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs := []*Subscription{}
+	for i := 0; i < 10; i++ {
+		sub, err := c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	// Every way a subscription ends, at the same time. A second close of
+	// EventStream panics.
+	var wg sync.WaitGroup
+
+	for _, sub := range subs {
+		wg.Add(3)
+		go func(sub *Subscription) {
+			defer wg.Done()
+			sub.Close()
+		}(sub)
+		go func(sub *Subscription) {
+			defer wg.Done()
+			sub.end("closed by relay")
+		}(sub)
+		go func(sub *Subscription) {
+			defer wg.Done()
+			c.dispatch(sub, subMessage{eose: true})
+		}(sub)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Close()
+	}()
+
+	wg.Wait()
+
+	for _, sub := range subs {
+		for range sub.EventStream {
+		}
+		<-sub.Closed()
+	}
+}
+
+func TestFireAfterClose(t *testing.T) {
+
+	r := testRelay(t)
+	c := NewConnection(r.URL)
+
+	err := c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := NewSubscription()
+	sub.conn = c
+	defer sub.Close()
+
+	c.Close()
+
+	// Nothing drains the REQ stream of a closed connection.
+	fired := make(chan error, 1)
+	go func() {
+		fired <- sub.Fire(nostr.Filters{{Kinds: []uint32{1}}}, make(chan nostr.MessageReq))
+	}()
+
+	select {
+	case err := <-fired:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Fatalf("got %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fire blocked on a closed connection")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/dextryz/ixian/negentropy"
+	"github.com/dextryz/nostr"
+)
+
+// NIP-77 negentropy syncing.
+const nipNegentropy = 77
+
+// Ids asked for in one REQ after reconciling.
+const syncIdsPerReq = 250
+
+// Pull only the author's articles missing from the cache. Relays that
+// advertise NIP-77 are reconciled with the cached set and asked for the
+// missing ids. The others, and those where reconciliation fails, are asked
+// for articles since the newest one cached.
+func (s *Repository) syncArticles(ctx context.Context, relays []*Connection, pk string) *QueryResult {
+
+	items, err := s.db.queryArticleItems(ctx, pk)
+	if err != nil {
+		log.Printf("sync %s: unable to read cached articles: %v", pk, err)
+		items = []negentropy.Item{}
+	}
+
+	f := nostr.Filter{
+		Authors: []string{pk},
+		Kinds:   []uint32{nostr.KindArticle},
+	}
+
+	results := make(chan *QueryResult, len(relays))
+
+	var wg sync.WaitGroup
+
+	for _, ws := range usable(relays, f) {
+
+		wg.Add(1)
+
+		go func(ws *Connection) {
+			defer wg.Done()
+
+			if ws.Supports(nipNegentropy) {
+				res, err := s.reconcile(ctx, ws, f, items)
+				if err == nil {
+					results <- res
+					return
+				}
+				log.Printf("relay %s: negentropy failed, falling back to since: %v", ws.Url(), err)
+			}
+
+			results <- s.since(ctx, ws, f, items)
+		}(ws)
+	}
+
+	wg.Wait()
+	close(results)
+
+	merged := &QueryResult{
+		Events: []*nostr.Event{},
+		RelayReport: RelayReport{
+			Answered: []string{},
+			TimedOut: []string{},
+		},
+	}
+
+	seen := make(map[string]struct{})
+
+	for res := range results {
+
+		merged.Answered = append(merged.Answered, res.Answered...)
+		merged.TimedOut = append(merged.TimedOut, res.TimedOut...)
+
+		for _, e := range res.Events {
+			if _, ok := seen[e.Id]; ok {
+				continue
+			}
+			seen[e.Id] = struct{}{}
+			merged.Events = append(merged.Events, e)
+		}
+	}
+
+	return merged
+}
+
+// Reconcile the cached set with the relay and REQ the ids it is missing.
+func (s *Repository) reconcile(ctx context.Context, ws *Connection, f nostr.Filter, items []negentropy.Item) (*QueryResult, error) {
+
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	negCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	need, err := ws.Reconcile(negCtx, f, items)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("relay %s: negentropy found %d missing of %d cached", ws.Url(), len(need), len(items))
+
+	res := &QueryResult{
+		Events: []*nostr.Event{},
+		RelayReport: RelayReport{
+			Answered: []string{ws.Url()},
+			TimedOut: []string{},
+		},
+	}
+
+	for len(need) > 0 {
+
+		n := min(len(need), syncIdsPerReq)
+
+		chunk := nostr.Filter{
+			Ids:   need[:n],
+			Limit: n,
+		}
+		need = need[n:]
+
+		part := s.fanOut(ctx, []*Connection{ws}, chunk)
+
+		res.Events = append(res.Events, part.Events...)
+
+		if len(part.TimedOut) > 0 {
+			res.Answered = []string{}
+			res.TimedOut = part.TimedOut
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// REQ articles created since the newest cached one, or all of them when
+// nothing is cached yet.
+func (s *Repository) since(ctx context.Context, ws *Connection, f nostr.Filter, items []negentropy.Item) *QueryResult {
+
+	f.Limit = s.db.QueryLimit
+
+	if len(items) > 0 {
+		var newest uint64
+		for _, item := range items {
+			newest = max(newest, item.Timestamp)
+		}
+		since := nostr.Timestamp(newest)
+		f.Since = &since
+	}
+
+	return s.fanOut(ctx, []*Connection{ws}, f)
+}
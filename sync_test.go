@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dextryz/ixian/relaytest"
+	"github.com/dextryz/nostr"
+)
+
+func TestSyncArticles(t *testing.T) {
+
+	ctx := context.Background()
+
+	cached := signedEvent(t, 30023, "# Cached", 200, nostr.Tag{"d", "cached"})
+	older := signedEvent(t, 30023, "# Older", 100, nostr.Tag{"d", "older"})
+	newer := signedEvent(t, 30023, "# Newer", 300, nostr.Tag{"d", "newer"})
+
+	nip77 := map[string]any{"supported_nips": []int{1, 11, 77}}
+
+	tests := []struct {
+		name string
+
+		// NIP-77 advertised in the relay's NIP-11 document.
+		advertised bool
+
+		// NEG-OPEN answered, otherwise the relay replies with a NOTICE.
+		negentropy bool
+
+		// The article older than the cached one is pulled, since misses it.
+		older bool
+	}{
+		{"negentropy", true, true, true},
+		{"negentropy failing falls back to since", true, false, false},
+		{"since without NIP-77", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			r := testRelay(t, cached, older, newer)
+			if tt.advertised {
+				r.SetInfo(nip77)
+			}
+			r.SetNegentropy(tt.negentropy)
+
+			s := testRepository(t, r)
+
+			_, err := s.db.StoreArticle(ctx, &cached)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pk, _ := nostr.GetPublicKey(testSk)
+
+			relays, release := s.Relays()
+			defer release()
+
+			res := s.syncArticles(ctx, relays, pk)
+
+			if len(res.Answered) != 1 {
+				t.Fatalf("report %+v, want the relay to answer", res.RelayReport)
+			}
+
+			got := make(map[string]bool)
+			for _, e := range res.Events {
+				got[e.Id] = true
+			}
+
+			if !got[newer.Id] {
+				t.Errorf("newer article not pulled")
+			}
+
+			if got[older.Id] != tt.older {
+				t.Errorf("older article pulled: %v, want %v", got[older.Id], tt.older)
+			}
+
+			// Since is inclusive, only reconciliation skips the cached one.
+			if tt.negentropy && got[cached.Id] {
+				t.Errorf("cached article pulled again")
+			}
+
+			if tt.negentropy && !negOpened(r) {
+				t.Errorf("no NEG-OPEN sent")
+			}
+		})
+	}
+}
+
+// Whether the relay received a NIP-77 session.
+func negOpened(r *relaytest.Relay) bool {
+
+	for _, raw := range r.Received() {
+		if len(raw) > 12 && string(raw[:12]) == `["NEG-OPEN",` {
+			return true
+		}
+	}
+
+	return false
+}
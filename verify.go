@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/dextryz/nostr"
+)
+
+var ErrInvalidId = errors.New("invalid event: id does not match content")
+var ErrInvalidSig = errors.New("invalid event: bad signature")
+
+// Events dropped because they failed verification, per relay.
+var relayInvalid = expvar.NewMap("relay_invalid_events")
+
+// Events verified while the relay reader waits for them, per connection.
+// Beyond this the reader blocks until earlier events are delivered.
+const verifyBacklog = 256
+
+// Check that the id is the hash of the serialized event and that the
+// signature over it is valid for the pubkey.
+func Verify(e *nostr.Event) error {
+
+	hash := sha256.Sum256(serialize(e))
+
+	if hex.EncodeToString(hash[:]) != e.Id {
+		return ErrInvalidId
+	}
+
+	raw, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return ErrInvalidSig
+	}
+
+	pk, err := schnorr.ParsePubKey(raw)
+	if err != nil {
+		return ErrInvalidSig
+	}
+
+	raw, err = hex.DecodeString(e.Sig)
+	if err != nil {
+		return ErrInvalidSig
+	}
+
+	sig, err := schnorr.ParseSignature(raw)
+	if err != nil {
+		return ErrInvalidSig
+	}
+
+	if !sig.Verify(hash[:], pk) {
+		return ErrInvalidSig
+	}
+
+	return nil
+}
+
+// NIP-01 serialization the event id is hashed from:
+// [0, <pubkey>, <created_at>, <kind>, <tags>, <content>]
+func serialize(e *nostr.Event) []byte {
+
+	b := []byte(`[0,`)
+	b = appendString(b, e.PubKey)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(e.CreatedAt), 10)
+	b = append(b, ',')
+	b = strconv.AppendUint(b, uint64(e.Kind), 10)
+	b = append(b, ",["...)
+
+	for i, t := range e.Tags {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '[')
+		for j, v := range t {
+			if j > 0 {
+				b = append(b, ',')
+			}
+			b = appendString(b, v)
+		}
+		b = append(b, ']')
+	}
+
+	b = append(b, "],"...)
+	b = appendString(b, e.Content)
+	b = append(b, ']')
+
+	return b
+}
+
+// JSON string with only the escapes NIP-01 allows, everything else is
+// written verbatim. encoding/json would also escape <, > and &.
+func appendString(b []byte, s string) []byte {
+
+	b = append(b, '"')
+
+	for i := 0; i < len(s); {
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		switch r {
+		case '\n':
+			b = append(b, `\n`...)
+		case '"':
+			b = append(b, `\"`...)
+		case '\\':
+			b = append(b, `\\`...)
+		case '\r':
+			b = append(b, `\r`...)
+		case '\t':
+			b = append(b, `\t`...)
+		case '\b':
+			b = append(b, `\b`...)
+		case '\f':
+			b = append(b, `\f`...)
+		default:
+			b = append(b, s[i:i+size]...)
+		}
+
+		i += size
+	}
+
+	return append(b, '"')
+}
+
+// Message waiting for its event to be verified before it is dispatched.
+type verifyJob struct {
+	sub *Subscription
+	msg subMessage
+
+	// Receives the outcome once, nil for valid events and EOSE.
+	result chan error
+}
+
+// Workers shared by all connections, so verification is bounded by the
+// number of CPUs however many relays are connected.
+var (
+	verifyOnce  sync.Once
+	verifyQueue chan *verifyJob
+)
+
+func startVerifiers() {
+
+	verifyQueue = make(chan *verifyJob, verifyBacklog)
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go func() {
+			for job := range verifyQueue {
+				job.result <- Verify(job.msg.event)
+			}
+		}()
+	}
+}
+
+// Hand the message to the verifier workers and queue it for delivery in
+// the order it was read. EOSE skips the workers, it still waits behind the
+// events read before it.
+func (s *Connection) verify(sub *Subscription, m subMessage) {
+
+	verifyOnce.Do(startVerifiers)
+
+	job := &verifyJob{
+		sub:    sub,
+		msg:    m,
+		result: make(chan error, 1),
+	}
+
+	if m.event != nil {
+		select {
+		case verifyQueue <- job:
+		case <-s.done:
+			return
+		}
+	} else {
+		job.result <- nil
+	}
+
+	select {
+	case s.verified <- job:
+	case <-s.done:
+	}
+}
+
+// Dispatch messages in the order they were read, once their event is
+// verified. Invalid events are counted and dropped.
+func (s *Connection) deliver() {
+
+	for {
+		var job *verifyJob
+
+		select {
+		case <-s.done:
+			return
+		case job = <-s.verified:
+		}
+
+		var err error
+
+		select {
+		case <-s.done:
+			return
+		case err = <-job.result:
+		}
+
+		if err != nil {
+			s.invalid.Add(1)
+			relayInvalid.Add(s.url, 1)
+			log.Printf("relay %s: dropped event %s: %v", s.url, job.msg.event.Id, err)
+			continue
+		}
+
+		s.dispatch(job.sub, job.msg)
+	}
+}
+
+// Number of events from the relay that failed verification.
+func (s *Connection) Invalid() int64 {
+	return s.invalid.Load()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/dextryz/nostr"
+)
+
+// Event signed outside of this package. Its id was hashed from the NIP-01
+// serialization below, escaping only what NIP-01 asks for.
+var signed = nostr.Event{
+	Id:        "1c7e079ea8602e9b20700dcc288aba3756dcc70b9b44deb12cc68e2fc5c07b86",
+	PubKey:    "17162c921dc4d2518f9a101db33695df1afb56ab82f5ff3e5da6eec3ca5cd917",
+	CreatedAt: 1700000000,
+	Kind:      1,
+	Tags: nostr.Tags{
+		{"t", "nostr"},
+		{"title", "Quotes \"and\" <tags> & ünïcødé"},
+	},
+	Content: "He said \"hi\" & left.\nSecond line: <b>bold</b> \\ back\ttab — ünïcødé 🚀",
+	Sig:     "0065eb51a8e3f530fe83cedce2a70bffa6ff3c7db99b1f8bb8844a608e2b52944afe08aadfc792043188e7afcdb2d8db88d880b6d1844743660a71bf2505b41c",
+}
+
+func TestSerialize(t *testing.T) {
+
+	want := `[0,"17162c921dc4d2518f9a101db33695df1afb56ab82f5ff3e5da6eec3ca5cd917",1700000000,1,` +
+		`[["t","nostr"],["title","Quotes \"and\" <tags> & ünïcødé"]],` +
+		`"He said \"hi\" & left.\nSecond line: <b>bold</b> \\ back\ttab — ünïcødé 🚀"]`
+
+	e := signed
+
+	if got := string(serialize(&e)); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+
+	e.Tags = nostr.Tags{}
+
+	want = `[0,"17162c921dc4d2518f9a101db33695df1afb56ab82f5ff3e5da6eec3ca5cd917",1700000000,1,[],` +
+		`"He said \"hi\" & left.\nSecond line: <b>bold</b> \\ back\ttab — ünïcødé 🚀"]`
+
+	if got := string(serialize(&e)); got != want {
+		t.Fatalf("without tags got  %s\nwant %s", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	tampered := func(edit func(e *nostr.Event)) *nostr.Event {
+		e := signed
+		e.Tags = append(nostr.Tags{}, signed.Tags...)
+		edit(&e)
+		return &e
+	}
+
+	other := signedEvent(t, 1, "other", 100)
+
+	tests := []struct {
+		name  string
+		event *nostr.Event
+		want  error
+	}{
+		{"known good", tampered(func(e *nostr.Event) {}), nil},
+		{"content", tampered(func(e *nostr.Event) { e.Content += "!" }), ErrInvalidId},
+		{"tag", tampered(func(e *nostr.Event) { e.Tags[0] = nostr.Tag{"t", "bitcoin"} }), ErrInvalidId},
+		{"created_at", tampered(func(e *nostr.Event) { e.CreatedAt++ }), ErrInvalidId},
+		{"id", tampered(func(e *nostr.Event) { e.Id = other.Id }), ErrInvalidId},
+		{"signature of another event", tampered(func(e *nostr.Event) { e.Sig = other.Sig }), ErrInvalidSig},
+		{"signature bit flipped", tampered(func(e *nostr.Event) { e.Sig = "1" + e.Sig[1:] }), ErrInvalidSig},
+		{"signature not hex", tampered(func(e *nostr.Event) { e.Sig = "zz" }), ErrInvalidSig},
+		{"pubkey", tampered(func(e *nostr.Event) { e.PubKey = other.PubKey }), ErrInvalidId},
+	}
+
+	for _, tt := range tests {
+
+		err := Verify(tt.event)
+		if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyOnStore(t *testing.T) {
+
+	ctx := context.Background()
+
+	db := NewSqlite(filepath.Join(t.TempDir(), "nostr.db"))
+	defer db.Close()
+
+	e := signed
+
+	err := db.StoreEvent(ctx, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Content = "forged"
+
+	err = db.StoreEvent(ctx, &e)
+	if !errors.Is(err, ErrInvalidId) {
+		t.Fatalf("got %v, want ErrInvalidId", err)
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+
+	forged := signed
+	forged.Content = "forged"
+
+	badSig := signedEvent(t, 1, "bad signature", 100)
+	badSig.Sig = signed.Sig
+
+	r := testRelay(t, signed, forged, badSig, signedEvent(t, 1, "valid", 200))
+	c := testConnection(t, r)
+
+	sub, err := c.Subscribe(nostr.Filters{{Kinds: []uint32{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	got := drain(t, sub)
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want the 2 valid ones", len(got))
+	}
+
+	if c.Invalid() != 2 {
+		t.Fatalf("%d events counted invalid, want 2", c.Invalid())
+	}
+}